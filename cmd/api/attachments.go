@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/storage"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// createAttachmentHandler for the POST "/v1/schools/:id/attachments" endpoint.
+// The request is multipart/form-data with a "kind" field and a "file" part.
+// The file is streamed straight to the blob store rather than buffered in memory
+func (app *application) createAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//make sure the school exists before accepting any data
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//a large file on a slow link takes longer than the server's read timeout allows
+	if err := app.extendTransferDeadlines(w); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	maxBytes := int64(app.config.storage.maxAttachmentSize) * 1024 * 1024
+	//leave some room for the multipart headers and the kind field
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64*1024)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	attachment := &data.Attachment{
+		SchoolID:   id,
+		StorageKey: fmt.Sprintf("schools/%d/%s", id, randomHex(16)),
+	}
+	stored := false
+	//remove the blob if we don't get as far as recording its metadata
+	defer func() {
+		if stored && attachment.ID == 0 {
+			app.blobs.Delete(r.Context(), attachment.StorageKey)
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			app.multipartErrorResponse(w, r, err, maxBytes)
+			return
+		}
+		switch part.FormName() {
+		case "kind":
+			value, err := io.ReadAll(io.LimitReader(part, 64))
+			if err != nil {
+				app.multipartErrorResponse(w, r, err, maxBytes)
+				return
+			}
+			attachment.Kind = strings.TrimSpace(string(value))
+		case "file":
+			if stored {
+				app.badRequestResponse(w, r, errors.New("body must only contain a single file"))
+				return
+			}
+			attachment.Filename = filepath.Base(part.FileName())
+			//sniff the content type from the first 512 bytes rather than trusting the client
+			br := bufio.NewReaderSize(part, 512)
+			head, _ := br.Peek(512)
+			attachment.ContentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+
+			n, err := app.blobs.Put(r.Context(), attachment.StorageKey, io.LimitReader(br, maxBytes+1))
+			stored = true
+			if err != nil {
+				app.multipartErrorResponse(w, r, err, maxBytes)
+				return
+			}
+			if n > maxBytes {
+				app.contentTooLargeResponse(w, r, maxBytes)
+				return
+			}
+			attachment.Size = n
+		default:
+			app.badRequestResponse(w, r, fmt.Errorf("body contains unknown field %q", part.FormName()))
+			return
+		}
+	}
+
+	v := validator.New()
+	v.Check(stored, "file", "must be provided")
+	if data.ValidateAttachment(v, attachment); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Attachments.Insert(r.Context(), attachment)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.queueThumbnail(r.Context(), attachment)
+
+	headers := make(http.Header)
+	headers.Set("Location", attachmentURL(attachment))
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"attachment": app.attachmentResponse(attachment)}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAttachmentsHandler for the GET "/v1/schools/:id/attachments" endpoint
+func (app *application) listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	attachments, err := app.models.Attachments.GetAllForSchool(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	response := make([]envelope, len(attachments))
+	for i, attachment := range attachments {
+		response[i] = app.attachmentResponse(attachment)
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"attachments": response}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showAttachmentHandler for the GET "/v1/schools/:id/attachments/:attachment_id" endpoint.
+// It streams the file and supports Range and conditional requests
+func (app *application) showAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := app.readAttachment(w, r)
+	if !ok {
+		return
+	}
+	blob, err := app.blobs.Open(r.Context(), attachment.StorageKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrBlobNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer blob.Close()
+	if err := app.extendTransferDeadlines(w); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, attachment.Filename, attachment.CreatedAt, blob)
+}
+
+// The extendTransferDeadlines() method gives an attachment upload or download
+// the storage transfer timeout to finish in, in place of the server's read and
+// write timeouts which are sized for JSON requests
+func (app *application) extendTransferDeadlines(w http.ResponseWriter) error {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(app.config.storage.transferTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// showThumbnailHandler for the GET "/v1/schools/:id/attachments/:attachment_id/thumbnail" endpoint.
+// It 404s until the background worker has generated the thumbnail
+func (app *application) showThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := app.readAttachment(w, r)
+	if !ok {
+		return
+	}
+	if attachment.ThumbnailKey == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+	blob, err := app.blobs.Open(r.Context(), attachment.ThumbnailKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrBlobNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", attachment.ThumbnailContentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", attachment.CreatedAt, blob)
+}
+
+// deleteAttachmentHandler for the DELETE "/v1/schools/:id/attachments/:attachment_id" endpoint
+func (app *application) deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	attachmentID, err := app.readInt64Param(r, "attachment_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	keys, err := app.models.Attachments.Delete(r.Context(), id, attachmentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.deleteBlobs(r, keys...)
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "attachment successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readAttachment() method looks up the attachment named by the route,
+// sending a 404 or 500 response and returning false if it can't
+func (app *application) readAttachment(w http.ResponseWriter, r *http.Request) (*data.Attachment, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	attachmentID, err := app.readInt64Param(r, "attachment_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	attachment, err := app.models.Attachments.Get(r.Context(), id, attachmentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return attachment, true
+}
+
+// The deleteBlobs() method removes blobs whose metadata has already been deleted.
+// Failures are only logged as the record is gone either way
+func (app *application) deleteBlobs(r *http.Request, keys ...string) {
+	for _, key := range keys {
+		if err := app.blobs.Delete(r.Context(), key); err != nil {
+			app.logError(r, err)
+		}
+	}
+}
+
+// The attachmentResponse() method adds the download and thumbnail URLs to an attachment's metadata
+func (app *application) attachmentResponse(attachment *data.Attachment) envelope {
+	response := envelope{
+		"id":           attachment.ID,
+		"created_at":   attachment.CreatedAt,
+		"school_id":    attachment.SchoolID,
+		"kind":         attachment.Kind,
+		"filename":     attachment.Filename,
+		"content_type": attachment.ContentType,
+		"size":         attachment.Size,
+		"url":          attachmentURL(attachment),
+	}
+	if attachment.ThumbnailKey != "" {
+		response["thumbnail_url"] = thumbnailURL(attachment.SchoolID, attachment.ID)
+	}
+	return response
+}
+
+// The multipartErrorResponse() method maps errors from reading an upload onto a response
+func (app *application) multipartErrorResponse(w http.ResponseWriter, r *http.Request, err error, maxBytes int64) {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesError):
+		app.contentTooLargeResponse(w, r, maxBytes)
+	case errors.Is(err, io.ErrUnexpectedEOF), strings.HasPrefix(err.Error(), "multipart:"):
+		app.badRequestResponse(w, r, errors.New("body contains badly formed multipart data"))
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func attachmentURL(attachment *data.Attachment) string {
+	return fmt.Sprintf("/v1/schools/%d/attachments/%d", attachment.SchoolID, attachment.ID)
+}
+
+func thumbnailURL(schoolID, attachmentID int64) string {
+	return fmt.Sprintf("/v1/schools/%d/attachments/%d/thumbnail", schoolID, attachmentID)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+const (
+	//maxBatchOperations caps the operations in one batch request
+	maxBatchOperations = 100
+	//The batch modes. An atomic batch is applied all-or-nothing in a single
+	//transaction, a per_item batch applies every operation that succeeds
+	batchAtomic  = "atomic"
+	batchPerItem = "per_item"
+)
+
+// errBatchFailed rolls back an atomic batch in which an operation failed
+var errBatchFailed = errors.New("batch operation failed")
+
+// batchOperation is one create, update or delete in a batch. Updates and
+// deletes must give the version of the school they expect to change
+type batchOperation struct {
+	Op      string          `json:"op"`
+	ID      int64           `json:"id"`
+	Version *int32          `json:"version"`
+	School  json.RawMessage `json:"school"`
+}
+
+// batchResult reports the outcome of one operation with the status code and
+// error the single-school endpoint would have responded with
+type batchResult struct {
+	Index  int          `json:"index"`
+	Op     string       `json:"op"`
+	Status int          `json:"status"`
+	School *data.School `json:"school,omitempty"`
+	Error  any          `json:"error,omitempty"`
+
+	id       int64    //the school the operation applied to
+	blobKeys []string //attachment files to purge once a delete is committed
+}
+
+// batchSchoolsHandler for the POST "/v1/schools/batch" endpoint. It applies a
+// list of school creates, updates and deletes. In atomic mode, the default,
+// they run in one transaction and nothing is applied unless every one
+// succeeds; the response then has the status of the first operation that
+// failed. In per_item mode each operation stands on its own
+func (app *application) batchSchoolsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Mode == "" {
+		input.Mode = batchAtomic
+	}
+	v := validator.New()
+	v.Check(validator.In(input.Mode, batchAtomic, batchPerItem), "mode", "must be atomic or per_item")
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= maxBatchOperations, "operations", fmt.Sprintf("must contain at most %d operations", maxBatchOperations))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results := make([]*batchResult, len(input.Operations))
+	if input.Mode == batchPerItem {
+		for i, op := range input.Operations {
+			//each operation gets a transaction of its own for it and its event
+			err = app.transaction(r.Context(), func(tx data.Models) error {
+				result, err := app.runBatchOperation(r, tx, i, op)
+				if err != nil {
+					return err
+				}
+				results[i] = result
+				if !result.succeeded() {
+					return errBatchFailed
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errBatchFailed) {
+				//earlier operations are already saved, so report this one and carry on
+				app.logError(r, err)
+				results[i] = &batchResult{Index: i, Op: op.Op, Status: http.StatusInternalServerError, Error: serverErrorMessage}
+				continue
+			}
+			app.finishBatchOperation(r, results[i])
+		}
+		err = app.writeJSON(w, r, http.StatusOK, envelope{"results": results}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//carry on after a failure so the client sees every operation that would fail.
+	//A failed statement aborts the transaction, so each operation runs under a
+	//savepoint that is rolled back when it fails, leaving the rest free to run
+	var failed *batchResult
+	err = app.transaction(r.Context(), func(tx data.Models) error {
+		for i, op := range input.Operations {
+			err := tx.Savepoint(r.Context(), func() (bool, error) {
+				result, err := app.runBatchOperation(r, tx, i, op)
+				if err != nil {
+					return false, err
+				}
+				results[i] = result
+				return result.succeeded(), nil
+			})
+			if err != nil {
+				return err
+			}
+			if failed == nil && !results[i].succeeded() {
+				failed = results[i]
+			}
+		}
+		if failed != nil {
+			return errBatchFailed
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errBatchFailed):
+		for _, result := range results {
+			if result.succeeded() {
+				result.Status = http.StatusFailedDependency
+				result.School = nil
+				result.Error = "not applied because another operation in the batch failed"
+			}
+		}
+		env := envelope{"error": "the batch was rolled back and no operations were applied", "results": results}
+		err = app.writeJSON(w, r, failed.Status, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, result := range results {
+		app.finishBatchOperation(r, result)
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The runBatchOperation() method applies one operation, and queues its event,
+// using models bound to a transaction. A client error is reported in the
+// result; the returned error is for failures the client can't fix
+func (app *application) runBatchOperation(r *http.Request, models data.Models, index int, op batchOperation) (*batchResult, error) {
+	result := &batchResult{Index: index, Op: op.Op, id: op.ID}
+
+	v := validator.New()
+	v.Check(validator.In(op.Op, "create", "update", "delete"), "op", "must be create, update or delete")
+	if op.Op == "create" {
+		v.Check(op.ID == 0, "id", "must not be provided when creating a school")
+		v.Check(op.Version == nil, "version", "must not be provided when creating a school")
+	} else {
+		v.Check(op.ID > 0, "id", "must be provided")
+		v.Check(op.Version != nil, "version", "must be provided")
+	}
+	v.Check(op.Op == "delete" || len(op.School) > 0, "school", "must be provided")
+	v.Check(op.Op != "delete" || len(op.School) == 0, "school", "must not be provided when deleting a school")
+	if !v.Valid() {
+		return result.fail(http.StatusUnprocessableEntity, v.Errors), nil
+	}
+
+	var input schoolInput
+	if op.Op != "delete" {
+		dec := json.NewDecoder(bytes.NewReader(op.School))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&input); err != nil {
+			return result.fail(http.StatusBadRequest, fmt.Sprintf("school is not a valid school object: %v", err)), nil
+		}
+	}
+
+	ctx := r.Context()
+	school := &data.School{}
+	if op.Op != "create" {
+		var err error
+		school, err = models.Schools.Get(ctx, op.ID)
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return result.fail(http.StatusNotFound, notFoundMessage), nil
+		case err != nil:
+			return nil, err
+		}
+		if school.Version != *op.Version {
+			return result.fail(http.StatusConflict, editConflictMessage), nil
+		}
+	}
+
+	switch op.Op {
+	case "create", "update":
+		input.apply(school)
+		if data.ValidateSchool(v, school); !v.Valid() {
+			return result.fail(http.StatusUnprocessableEntity, v.Errors), nil
+		}
+		var err error
+		if op.Op == "create" {
+			err = models.Schools.Insert(ctx, school)
+			result.Status = http.StatusCreated
+		} else {
+			err = models.Schools.Update(ctx, school)
+			result.Status = http.StatusOK
+		}
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return result.fail(http.StatusConflict, editConflictMessage), nil
+		case errors.Is(err, data.ErrDuplicateExternalID):
+			return result.fail(http.StatusUnprocessableEntity, duplicateExternalIDErrors), nil
+		case err != nil:
+			return nil, err
+		}
+		result.id = school.ID
+		result.School = school
+		event := "school.created"
+		if op.Op == "update" {
+			event = "school.updated"
+		}
+		if err := app.emitEvent(ctx, models, event, envelope{"school": school}); err != nil {
+			return nil, err
+		}
+	case "delete":
+		attachments, err := models.Attachments.GetAllForSchool(ctx, op.ID)
+		if err != nil {
+			return nil, err
+		}
+		err = models.Schools.DeleteVersion(ctx, op.ID, *op.Version)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return result.fail(http.StatusConflict, editConflictMessage), nil
+		case err != nil:
+			return nil, err
+		}
+		if err := app.emitEvent(ctx, models, "school.deleted", envelope{"school": envelope{"id": op.ID}}); err != nil {
+			return nil, err
+		}
+		for _, attachment := range attachments {
+			result.blobKeys = append(result.blobKeys, attachment.BlobKeys()...)
+		}
+		result.Status = http.StatusOK
+	}
+	return result, nil
+}
+
+// The finishBatchOperation() method does the work that follows a committed
+// operation, purging a deleted school's files
+func (app *application) finishBatchOperation(r *http.Request, result *batchResult) {
+	if result.succeeded() && result.Op == "delete" {
+		app.deleteBlobs(r, result.blobKeys...)
+	}
+}
+
+// The succeeded() method reports whether the operation was applied
+func (result *batchResult) succeeded() bool {
+	return result.Status < http.StatusBadRequest
+}
+
+// The fail() method records why an operation failed
+func (result *batchResult) fail(status int, message any) *batchResult {
+	result.Status = status
+	result.School = nil
+	result.Error = message
+	return result
+}
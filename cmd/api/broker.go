@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/lib/pq"
+)
+
+// changeChannel is the channel the schools trigger NOTIFYs on
+const changeChannel = "school_changes"
+
+// changeBroker fans the school change feed out to the connected streams. A
+// NOTIFY only wakes it up, the changes themselves are always read from the
+// school_changes table in sequence order, so a missed notification delays
+// changes rather than losing them
+type changeBroker struct {
+	model    data.ChangeModel
+	logger   *jsonlog.Logger
+	listener *pq.Listener
+	lastSeq  int64 //only used by run()
+
+	mu          sync.Mutex
+	subscribers map[chan *data.SchoolChange]struct{}
+	closed      bool
+}
+
+// The openChangeBroker() function starts listening for change notifications
+// and returns a broker that publishes everything after the newest existing change
+func openChangeBroker(cf config, model data.ChangeModel, logger *jsonlog.Logger) (*changeBroker, error) {
+	logger = logger.With(jsonlog.String("component", "changefeed"))
+	listener := pq.NewListener(cf.db.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error(err)
+		}
+	})
+	if err := listener.Listen(changeChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lastSeq, err := model.Latest(ctx)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	b := &changeBroker{
+		model:       model,
+		logger:      logger,
+		listener:    listener,
+		lastSeq:     lastSeq,
+		subscribers: make(map[chan *data.SchoolChange]struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// run() publishes new changes whenever a notification arrives. The listener
+// sends nil after reconnecting, and the periodic ping catches anything a quiet
+// connection might have dropped
+func (b *changeBroker) run() {
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+			if err := b.listener.Ping(); err != nil {
+				b.logger.Error(err)
+			}
+		}
+		b.catchUp()
+	}
+}
+
+// catchUp() publishes every change after the last one published
+func (b *changeBroker) catchUp() {
+	const pageSize = 100
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		changes, err := b.model.GetAfter(ctx, b.lastSeq, pageSize)
+		cancel()
+		if err != nil {
+			b.logger.Error(err)
+			return
+		}
+		for _, change := range changes {
+			b.publish(change)
+			b.lastSeq = change.Seq
+		}
+		if len(changes) < pageSize {
+			return
+		}
+	}
+}
+
+// publish() hands a change to every subscriber. A subscriber that has fallen
+// behind is dropped rather than allowed to hold up the others; its stream ends
+// and the client resumes from its Last-Event-ID
+func (b *changeBroker) publish(change *data.SchoolChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- change:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe() returns a channel of new changes, which is closed if the
+// subscriber is dropped or the broker shuts down, and a function that unsubscribes
+func (b *changeBroker) subscribe() (<-chan *data.SchoolChange, func()) {
+	ch := make(chan *data.SchoolChange, 64)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// close() ends every stream and stops listening. It runs when the server
+// shuts down, as open streams would otherwise hold the shutdown up
+func (b *changeBroker) close() {
+	b.mu.Lock()
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+	if err := b.listener.Close(); err != nil {
+		b.logger.Error(err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// showOpeningHoursHandler for the GET "/v1/schools/:id/hours" endpoint. The
+// hours are given with the time zone they are in
+func (app *application) showOpeningHoursHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	school, err := app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	hours, err := app.models.Calendar.GetOpeningHours(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"time_zone": school.TimeZone, "hours": hours}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// replaceOpeningHoursHandler for the PUT "/v1/schools/:id/hours" endpoint. The
+// body is the school's whole week, which replaces the hours it had. An empty
+// list leaves the school with no opening hours
+func (app *application) replaceOpeningHoursHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		Hours []data.OpeningHours `json:"hours"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Hours != nil, "hours", "must be provided")
+	if data.ValidateOpeningHours(v, input.Hours); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx := r.Context()
+	var school *data.School
+	var hours []data.OpeningHours
+	err = app.models.Transaction(ctx, func(tx data.Models) error {
+		if err := tx.Calendar.ReplaceOpeningHours(ctx, id, input.Hours); err != nil {
+			return err
+		}
+		var err error
+		school, err = tx.Schools.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		hours, err = tx.Calendar.GetOpeningHours(ctx, id)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"time_zone": school.TimeZone, "hours": hours}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listClosuresHandler for the GET "/v1/schools/:id/closures" endpoint
+func (app *application) listClosuresHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	closures, err := app.models.Calendar.GetClosures(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"closures": closures}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createClosureHandler for the POST "/v1/schools/:id/closures" endpoint. A
+// closure may not overlap the school's other closures
+func (app *application) createClosureHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input struct {
+		StartsOn string `json:"starts_on"`
+		EndsOn   string `json:"ends_on"`
+		Reason   string `json:"reason"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	closure := &data.Closure{
+		SchoolID: id,
+		StartsOn: input.StartsOn,
+		EndsOn:   input.EndsOn,
+		Reason:   input.Reason,
+	}
+	v := validator.New()
+	if data.ValidateClosure(v, closure); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Calendar.InsertClosure(r.Context(), closure)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrOverlappingClosure):
+			app.failedValidationResponse(w, r, map[string]string{"starts_on": "overlaps another closure of this school"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"closure": closure}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteClosureHandler for the DELETE "/v1/schools/:id/closures/:closure_id" endpoint
+func (app *application) deleteClosureHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	closureID, err := app.readInt64Param(r, "closure_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Calendar.DeleteClosure(r.Context(), id, closureID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "closure successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
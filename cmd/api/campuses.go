@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// schoolWithCampuses is a school with its campuses embedded, for include=campuses
+type schoolWithCampuses struct {
+	*data.School
+	Campuses []*data.Campus `json:"campuses"`
+}
+
+// The embedCampuses() method loads the campuses of every school with one query
+// and returns the schools with their campuses embedded
+func (app *application) embedCampuses(r *http.Request, schools ...*data.School) ([]schoolWithCampuses, error) {
+	ids := make([]int64, len(schools))
+	for i, school := range schools {
+		ids[i] = school.ID
+	}
+	campuses, err := app.models.Campuses.GetAllForSchools(r.Context(), ids)
+	if err != nil {
+		return nil, err
+	}
+	embedded := make([]schoolWithCampuses, len(schools))
+	for i, school := range schools {
+		embedded[i] = schoolWithCampuses{School: school, Campuses: campuses[school.ID]}
+		if embedded[i].Campuses == nil {
+			embedded[i].Campuses = []*data.Campus{}
+		}
+	}
+	return embedded, nil
+}
+
+// listCampusesHandler for the GET "/v1/schools/:id/campuses" endpoint
+func (app *application) listCampusesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	campuses, err := app.models.Campuses.GetAllForSchool(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"campuses": campuses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createCampusHandler for the POST "/v1/schools/:id/campuses" endpoint
+func (app *application) createCampusHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input struct {
+		Name    string   `json:"name"`
+		Address string   `json:"address"`
+		Phone   string   `json:"phone"`
+		Mode    []string `json:"mode"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	campus := &data.Campus{
+		SchoolID: id,
+		Name:     input.Name,
+		Address:  input.Address,
+		Phone:    input.Phone,
+		Mode:     input.Mode,
+	}
+	v := validator.New()
+	if data.ValidateCampus(v, campus); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Campuses.Insert(r.Context(), campus)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/schools/%d/campuses/%d", id, campus.ID))
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"campus": campus}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCampusHandler for the GET "/v1/schools/:id/campuses/:campus_id" endpoint
+func (app *application) showCampusHandler(w http.ResponseWriter, r *http.Request) {
+	campus, ok := app.readCampus(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"campus": campus}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCampusHandler for the PATCH "/v1/schools/:id/campuses/:campus_id" endpoint.
+// Like a school, fields left out of the body keep their values
+func (app *application) updateCampusHandler(w http.ResponseWriter, r *http.Request) {
+	campus, ok := app.readCampus(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Name    *string  `json:"name"`
+		Address *string  `json:"address"`
+		Phone   *string  `json:"phone"`
+		Mode    []string `json:"mode"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Name != nil {
+		campus.Name = *input.Name
+	}
+	if input.Address != nil {
+		campus.Address = *input.Address
+	}
+	if input.Phone != nil {
+		campus.Phone = *input.Phone
+	}
+	if input.Mode != nil {
+		campus.Mode = input.Mode
+	}
+	v := validator.New()
+	if data.ValidateCampus(v, campus); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Campuses.Update(r.Context(), campus)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"campus": campus}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCampusHandler for the DELETE "/v1/schools/:id/campuses/:campus_id" endpoint
+func (app *application) deleteCampusHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	campusID, err := app.readInt64Param(r, "campus_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Campuses.Delete(r.Context(), id, campusID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "campus successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readCampus() method looks up the campus named by the route,
+// sending a 404 or 500 response and returning false if it can't
+func (app *application) readCampus(w http.ResponseWriter, r *http.Request) (*data.Campus, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	campusID, err := app.readInt64Param(r, "campus_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	campus, err := app.models.Campuses.Get(r.Context(), id, campusID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return campus, true
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/kirwadee/appletree/internal/validator"
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration settings
+type config struct {
+	port int
+	env  string //development, production, staging
+	db   struct {
+		dsn          string
+		maxOpenConns int
+		maxIdleConns int
+		maxIdleTime  time.Duration
+	}
+	metrics struct {
+		port int
+	}
+	trace struct {
+		exporter string //none, stdout, file, otlp
+		file     string
+		endpoint string
+	}
+	log struct {
+		level            string
+		file             string
+		maxSize          int //megabytes
+		rotateInterval   time.Duration
+		maxBackups       int
+		stackTraces      bool
+		sampleFirst      int
+		sampleThereafter int
+	}
+	limiter struct {
+		enabled bool
+		rps     float64
+		burst   int
+	}
+	cors struct {
+		trustedOrigins stringList
+		maxAge         time.Duration
+	}
+	tls struct {
+		certFile     string
+		keyFile      string
+		clientCAFile string
+		clientAuth   string
+	}
+	storage struct {
+		dir               string
+		maxAttachmentSize int //megabytes
+		transferTimeout   time.Duration
+	}
+	thumbnail struct {
+		size int //pixels
+	}
+	jobs struct {
+		concurrency  int
+		pollInterval time.Duration
+		timeout      time.Duration
+		maxAttempts  int
+		retention    time.Duration
+	}
+	idempotency struct {
+		retention time.Duration
+	}
+	shutdownTimeout time.Duration
+	maintenance     bool
+}
+
+// stringList is a flag.Value holding a space separated list of strings
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = strings.Fields(value)
+	return nil
+}
+
+// cliActions are the flags that make the binary do something other than serve
+type cliActions struct {
+	displayVersion bool
+	printConfig    bool
+}
+
+// envPrefix is prepended to a setting's name to find its environment variable,
+// so db-max-open-conns is read from APPLETREE_DB_MAX_OPEN_CONNS
+const envPrefix = "APPLETREE_"
+
+// secretSettings lists the settings that are redacted by -print-config
+var secretSettings = map[string]bool{
+	"db-dsn": true,
+}
+
+// The newFlagSet() function declares every setting as a flag bound to cfg
+func newFlagSet(cfg *config, actions *cliActions, configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	//read in flags that are needed to populate config struct
+	fs.IntVar(&cfg.port, "port", 4000, "API Server Port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment(development | staging | production)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "Postgresql dsn")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "Postgresql max open conns")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "Postgresql max idle conns")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "Postgresql max connection idle time")
+	fs.IntVar(&cfg.metrics.port, "metrics-port", 0, "Admin port for /metrics (0 serves them on the API port)")
+	fs.StringVar(&cfg.trace.exporter, "trace-exporter", "none", "Tracing exporter(none | stdout | file | otlp)")
+	fs.StringVar(&cfg.trace.file, "trace-file", "traces.json", "File spans are written to by the file exporter")
+	fs.StringVar(&cfg.trace.endpoint, "trace-otlp-endpoint", "http://localhost:4318", "OTLP/HTTP collector endpoint")
+	fs.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level(debug | info | warn | error | fatal | off)")
+	fs.StringVar(&cfg.log.file, "log-file", "", "Write logs to this file instead of stdout")
+	fs.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Rotate the log file once it reaches this many megabytes(0 disables)")
+	fs.DurationVar(&cfg.log.rotateInterval, "log-rotate-interval", 24*time.Hour, "Rotate the log file after this long(0 disables)")
+	fs.IntVar(&cfg.log.maxBackups, "log-max-backups", 7, "Number of rotated log files to keep(0 keeps all)")
+	fs.BoolVar(&cfg.log.stackTraces, "log-stack-traces", false, "Include stack traces in error log entries")
+	fs.IntVar(&cfg.log.sampleFirst, "log-sample-first", 0, "Log the first N identical messages each second(0 disables sampling)")
+	fs.IntVar(&cfg.log.sampleThereafter, "log-sample-thereafter", 100, "After the first N, log every Mth identical message each second")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable per-client rate limiting")
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 10, "Rate limiter maximum requests per second per client")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 20, "Rate limiter maximum burst per client")
+	fs.Var(&cfg.cors.trustedOrigins, "cors-trusted-origins", "Trusted CORS origins (space separated)")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", time.Hour, "How long browsers may cache a CORS preflight response")
+	fs.StringVar(&cfg.tls.certFile, "tls-cert", "", "TLS certificate file, serves HTTPS and HTTP/2 when set")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key", "", "TLS private key file")
+	fs.StringVar(&cfg.tls.clientCAFile, "tls-client-ca", "", "CA bundle used to verify client certificates (enables mutual TLS)")
+	fs.StringVar(&cfg.tls.clientAuth, "tls-client-auth", "verify-if-given", "Client certificate policy with -tls-client-ca(verify-if-given | require)")
+	fs.StringVar(&cfg.storage.dir, "storage-dir", "./uploads", "Directory where school attachments are stored")
+	fs.IntVar(&cfg.storage.maxAttachmentSize, "storage-max-attachment-size", 10, "Largest attachment that can be uploaded, in megabytes")
+	fs.DurationVar(&cfg.storage.transferTimeout, "storage-transfer-timeout", 10*time.Minute, "How long an attachment upload or download may take, in place of the server's read and write timeouts")
+	fs.IntVar(&cfg.thumbnail.size, "thumbnail-size", 200, "Width and height of generated image thumbnails, in pixels")
+	fs.IntVar(&cfg.jobs.concurrency, "jobs-concurrency", 4, "Background jobs run at the same time")
+	fs.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", time.Second, "How often an idle dispatcher checks the jobs table")
+	fs.DurationVar(&cfg.jobs.timeout, "jobs-timeout", time.Minute, "How long a single attempt at a background job may run")
+	fs.IntVar(&cfg.jobs.maxAttempts, "jobs-max-attempts", 5, "Attempts before a failing job is dead-lettered")
+	fs.DurationVar(&cfg.jobs.retention, "jobs-retention", 7*24*time.Hour, "How long completed jobs are kept")
+	fs.DurationVar(&cfg.idempotency.retention, "idempotency-retention", 24*time.Hour, "How long an Idempotency-Key and its response are kept")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests and jobs to finish when shutting down")
+	fs.BoolVar(&cfg.maintenance, "maintenance", false, "Answer API requests with 503 while in maintenance mode")
+
+	//these flags are not settings so they are never read from the file or environment
+	fs.StringVar(configFile, "config", os.Getenv(envPrefix+"CONFIG"), "Path to a YAML config file, re-read on SIGHUP. Flags and environment variables override its values, also on reload")
+	fs.BoolVar(&actions.displayVersion, "version", false, "Display version and exit")
+	fs.BoolVar(&actions.printConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	return fs
+}
+
+// actionFlags are declared by newFlagSet() but aren't configuration settings
+var actionFlags = map[string]bool{"config": true, "version": true, "print-config": true}
+
+// shadowedSetting is a config file value that a flag or environment variable overrides
+type shadowedSetting struct {
+	name   string
+	source string
+}
+
+// The loadConfig() function builds the configuration from, in increasing order
+// of precedence, the defaults, the config file, APPLETREE_* environment
+// variables and command-line flags. Every value is validated before it is
+// returned, along with the config file values that were overridden
+func loadConfig(args []string) (config, cliActions, []shadowedSetting, error) {
+	var cfg config
+	var actions cliActions
+	var configFile string
+	var shadowed []shadowedSetting
+	fs := newFlagSet(&cfg, &actions, &configFile)
+	if err := fs.Parse(args); err != nil {
+		return cfg, actions, nil, err
+	}
+	//remember which flags were given explicitly as they win over everything else
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	fileValues := map[string]string{}
+	if configFile != "" {
+		var err error
+		fileValues, err = readConfigFile(configFile)
+		if err != nil {
+			return cfg, actions, nil, err
+		}
+		for name := range fileValues {
+			if fs.Lookup(name) == nil || actionFlags[name] {
+				return cfg, actions, nil, fmt.Errorf("config file %s: unknown setting %q", configFile, name)
+			}
+		}
+	}
+
+	//parse the file values on their own too, to compare them with the values that won
+	fileFlags := effectiveFlags(config{})
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if actionFlags[f.Name] {
+			return
+		}
+		fileValue, inFile := fileValues[f.Name]
+		source, value, ok := "", "", false
+		switch {
+		case explicit[f.Name]:
+			source = "-" + f.Name
+		case hasEnv(f.Name):
+			source, value, ok = envName(f.Name), os.Getenv(envName(f.Name)), true
+		case inFile:
+			source, value, ok = configFile, fileValue, true
+		}
+		if ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s from %s: %w", value, f.Name, source, err))
+				return
+			}
+		}
+		if inFile && source != configFile {
+			ff := fileFlags.Lookup(f.Name)
+			if ff.Value.Set(fileValue) == nil && ff.Value.String() != f.Value.String() {
+				shadowed = append(shadowed, shadowedSetting{name: f.Name, source: source})
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return cfg, actions, nil, errors.Join(errs...)
+	}
+
+	//don't insist on a valid config when we are only printing the version
+	if actions.displayVersion {
+		return cfg, actions, shadowed, nil
+	}
+	v := validator.New()
+	if validateConfig(v, cfg); !v.Valid() {
+		return cfg, actions, nil, validationError(v)
+	}
+	return cfg, actions, shadowed, nil
+}
+
+// The hasEnv() function reports whether a setting's environment variable is set
+func hasEnv(setting string) bool {
+	_, found := os.LookupEnv(envName(setting))
+	return found
+}
+
+// The envName() function returns the environment variable that holds a setting
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// The readConfigFile() function reads a YAML file and flattens it into setting
+// names, so that
+//
+//	db:
+//	  max_open_conns: 50
+//
+// sets db-max-open-conns. Lists become space separated values
+func readConfigFile(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	values := make(map[string]string)
+	var flatten func(prefix string, m map[string]any)
+	flatten = func(prefix string, m map[string]any) {
+		for key, value := range m {
+			name := strings.ReplaceAll(key, "_", "-")
+			if prefix != "" {
+				name = prefix + "-" + name
+			}
+			switch value := value.(type) {
+			case map[string]any:
+				flatten(name, value)
+			case []any:
+				items := make([]string, len(value))
+				for i, item := range value {
+					items[i] = fmt.Sprint(item)
+				}
+				values[name] = strings.Join(items, " ")
+			case nil:
+				values[name] = ""
+			default:
+				values[name] = fmt.Sprint(value)
+			}
+		}
+	}
+	flatten("", doc)
+	return values, nil
+}
+
+// The validateConfig() function checks every setting
+func validateConfig(v *validator.Validator, cfg config) {
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.In(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns > 0, "db-max-open-conns", "must be greater than 0")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns <= cfg.db.maxOpenConns, "db-max-idle-conns", "must not be more than db-max-open-conns")
+	v.Check(cfg.db.maxIdleTime > 0, "db-max-idle-time", "must be a positive duration")
+
+	v.Check(cfg.metrics.port >= 0 && cfg.metrics.port <= 65535, "metrics-port", "must be between 0 and 65535")
+	v.Check(cfg.metrics.port != cfg.port, "metrics-port", "must be different from port")
+
+	v.Check(validator.In(cfg.trace.exporter, "none", "stdout", "file", "otlp"), "trace-exporter", "must be none, stdout, file or otlp")
+	v.Check(cfg.trace.exporter != "file" || cfg.trace.file != "", "trace-file", "must be provided for the file exporter")
+	v.Check(cfg.trace.exporter != "otlp" || validator.ValidWebsite(cfg.trace.endpoint), "trace-otlp-endpoint", "must be a valid URL")
+
+	_, err := jsonlog.ParseLevel(cfg.log.level)
+	v.Check(err == nil, "log-level", "must be debug, info, warn, error, fatal or off")
+	v.Check(cfg.log.maxSize >= 0, "log-max-size", "must not be negative")
+	v.Check(cfg.log.rotateInterval >= 0, "log-rotate-interval", "must not be negative")
+	v.Check(cfg.log.maxBackups >= 0, "log-max-backups", "must not be negative")
+	v.Check(cfg.log.sampleFirst >= 0, "log-sample-first", "must not be negative")
+	v.Check(cfg.log.sampleThereafter >= 0, "log-sample-thereafter", "must not be negative")
+
+	v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than 0")
+	v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than 0")
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		v.Check(origin == "*" || validator.ValidWebsite(origin), "cors-trusted-origins", "must be a list of origins such as https://admin.example.com")
+	}
+	v.Check(cfg.cors.maxAge >= 0, "cors-max-age", "must not be negative")
+
+	v.Check(cfg.tls.certFile == "" || cfg.tls.keyFile != "", "tls-key", "must be provided with tls-cert")
+	v.Check(cfg.tls.keyFile == "" || cfg.tls.certFile != "", "tls-cert", "must be provided with tls-key")
+	v.Check(cfg.tls.clientCAFile == "" || cfg.tls.certFile != "", "tls-client-ca", "requires tls-cert and tls-key")
+	v.Check(validator.In(cfg.tls.clientAuth, "verify-if-given", "require"), "tls-client-auth", "must be verify-if-given or require")
+
+	v.Check(cfg.storage.dir != "", "storage-dir", "must be provided")
+	v.Check(cfg.storage.maxAttachmentSize > 0, "storage-max-attachment-size", "must be greater than 0")
+	v.Check(cfg.storage.transferTimeout > 0, "storage-transfer-timeout", "must be greater than 0")
+
+	v.Check(cfg.thumbnail.size >= 16 && cfg.thumbnail.size <= 1024, "thumbnail-size", "must be between 16 and 1024")
+
+	v.Check(cfg.jobs.concurrency > 0, "jobs-concurrency", "must be greater than 0")
+	v.Check(cfg.jobs.pollInterval > 0, "jobs-poll-interval", "must be greater than 0")
+	v.Check(cfg.jobs.timeout > 0, "jobs-timeout", "must be greater than 0")
+	v.Check(cfg.jobs.maxAttempts > 0, "jobs-max-attempts", "must be greater than 0")
+	v.Check(cfg.jobs.retention > 0, "jobs-retention", "must be greater than 0")
+
+	v.Check(cfg.idempotency.retention > 0, "idempotency-retention", "must be greater than 0")
+
+	v.Check(cfg.shutdownTimeout > 0, "shutdown-timeout", "must be greater than 0")
+}
+
+// The validationError() function combines the validator's errors into one error
+func validationError(v *validator.Validator) error {
+	keys := make([]string, 0, len(v.Errors))
+	for key := range v.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = fmt.Errorf("invalid configuration: %s %s", key, v.Errors[key])
+	}
+	return errors.Join(errs...)
+}
+
+// The printConfig() function writes the effective configuration as YAML, in
+// the same layout the config file uses, with secrets redacted
+func printConfig(w io.Writer, cfg config) error {
+	fs := effectiveFlags(cfg)
+	doc := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if actionFlags[f.Name] {
+			return
+		}
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			if _, isDuration := getter.Get().(time.Duration); !isDuration {
+				value = getter.Get()
+			}
+		}
+		if secretSettings[f.Name] {
+			value = redact(f.Value.String())
+		}
+		section, key, nested := strings.Cut(f.Name, "-")
+		if !nested {
+			doc[section] = value
+			return
+		}
+		m, ok := doc[section].(map[string]any)
+		if !ok {
+			m = make(map[string]any)
+			doc[section] = m
+		}
+		m[strings.ReplaceAll(key, "-", "_")] = value
+	})
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// The effectiveFlags() function returns a flag set bound to a copy of cfg, so
+// that its flags report the effective values rather than the defaults
+func effectiveFlags(cfg config) *flag.FlagSet {
+	var actions cliActions
+	var configFile string
+	bound := new(config)
+	fs := newFlagSet(bound, &actions, &configFile)
+	//declaring the flags resets bound to the defaults, so copy the values in afterwards
+	*bound = cfg
+	return fs
+}
+
+var passwordRx = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// The redact() function hides the password in a postgres URL or key=value DSN
+func redact(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return passwordRx.ReplaceAllString(dsn, "${1}xxxxx")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+)
+
+// contextKey is a custom type for the keys we store in a request context
+type contextKey string
+
+const (
+	routeInfoContextKey = contextKey("routeInfo")
+	requestIDContextKey = contextKey("requestID")
+)
+
+// routeInfo holds details about the route that matched a request. The outer
+// middleware places an empty routeInfo in the context and the router fills it
+// in once a route has been matched
+type routeInfo struct {
+	pattern string
+}
+
+// The contextSetRouteInfo() method returns a copy of the request with a routeInfo added to its context
+func (app *application) contextSetRouteInfo(r *http.Request, info *routeInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), routeInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRouteInfo() method retrieves the routeInfo from the request context.
+// It returns nil when no routeInfo has been set
+func (app *application) contextGetRouteInfo(r *http.Request) *routeInfo {
+	info, _ := r.Context().Value(routeInfoContextKey).(*routeInfo)
+	return info
+}
+
+// The contextSetRequestID() method returns a copy of the request with the request ID added to its context.
+// The ID is also added to every entry logged with the context
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	ctx = jsonlog.ContextWith(ctx, jsonlog.String("request_id", id))
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method retrieves the request ID from the request context.
+// It returns an empty string when no ID has been set
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
@@ -3,22 +3,36 @@ package main
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/kirwadee/appletree/internal/tracing"
+)
+
+// Messages shared by the error responses and the per-operation results of a batch
+const (
+	serverErrorMessage  = "server encountered a problem and could not process the request"
+	notFoundMessage     = "The requested resource could not be found"
+	editConflictMessage = "unable to update the record due to an edit conflict, please try again"
 )
 
 // logError logs error to the console
 func (app *application) logError(r *http.Request, err error) {
-	//log to the console
-	app.logger.PrintError(err, map[string]string{
-		"request_method": r.Method,
-		"request_url":    r.URL.String(),
-	})
+	//log to the console, the context adds the request ID
+	fields := []jsonlog.Field{
+		jsonlog.String("request_method", r.Method),
+		jsonlog.String("request_url", r.URL.String()),
+	}
+	if span := tracing.SpanFromContext(r.Context()); span != nil {
+		fields = append(fields, jsonlog.String("trace_id", span.TraceID.String()))
+	}
+	app.logger.ErrorContext(r.Context(), err, fields...)
 }
 
 // we want to send JSON formatted error to the client
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	//create JSON response
 	env := envelope{"error": message}
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeJSON(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -30,14 +44,12 @@ func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Reque
 	//log the error to the console terminal 1st
 	app.logError(r, err)
 	//prepare a message error
-	message := "server encountered a problem and could not process the request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, serverErrorMessage)
 }
 
 // not found response
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
-	message := "The requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, notFoundMessage)
 }
 
 // method not allowed response
@@ -58,6 +70,43 @@ func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.
 
 // JSON response error on edit conflict error
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
-	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, editConflictMessage)
+}
+
+// JSON response error when the request body is in a format the endpoint doesn't accept
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the %q content type is not supported for this resource", r.Header.Get("Content-Type"))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+// JSON response error when an Idempotency-Key is reused for a different request
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key has already been used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// JSON response error when the first request with an Idempotency-Key hasn't finished yet
+func (app *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "a request with this Idempotency-Key is still being processed, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
+
+// JSON response error when a client sends too many requests
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// JSON response error while the API is in maintenance mode
+func (app *application) maintenanceResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "300")
+	message := "the server is undergoing maintenance, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// JSON response error when an uploaded file is too large
+func (app *application) contentTooLargeResponse(w http.ResponseWriter, r *http.Request, maxBytes int64) {
+	message := fmt.Sprintf("the uploaded file must not be larger than %d bytes", maxBytes)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
@@ -1,24 +1,138 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/health"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	//create a map to hold our healthcheck data
 	data := envelope{
-		"status": "available",
-		"system_info": map[string]string{
-			"environment": app.config.env,
-			"version":     version,
-		},
+		"status":      "available",
+		"system_info": app.systemInfo(),
 	}
 	//convert data map into a json object
-	err := app.writeJSON(w, http.StatusOK, data, nil)
+	err := app.writeJSON(w, r, http.StatusOK, data, nil)
 	if err != nil {
-		app.logger.PrintError(err, nil)
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 }
+
+// The liveHealthcheckHandler() reports that the process is up and able to serve requests.
+// It does not touch any dependencies so that a slow database doesn't get the process restarted
+func (app *application) liveHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"status": "alive", "system_info": app.systemInfo()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readyHealthcheckHandler() runs every registered check and responds with
+// 503 Service Unavailable and per-check detail when any of them fails
+func (app *application) readyHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	healthy, checks := app.health.Run(r.Context())
+
+	status, code := "available", http.StatusOK
+	if !healthy {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	env := envelope{
+		"status":      status,
+		"checks":      checks,
+		"system_info": app.systemInfo(),
+	}
+	err := app.writeJSON(w, r, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The systemInfo() method describes the running build and environment
+func (app *application) systemInfo() map[string]string {
+	return map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+		"commit":      buildCommit(),
+		"build_time":  buildTimestamp(),
+		"go_version":  runtime.Version(),
+		"uptime":      time.Since(app.startedAt).Round(time.Second).String(),
+	}
+}
+
+// poolWaitThreshold is the average wait for a database connection, since the
+// last readiness check, at which the pool counts as exhausted
+const poolWaitThreshold = time.Second
+
+// The newHealthChecks() function registers the readiness checks for the database
+func newHealthChecks(db *sql.DB, models data.Models) *health.Registry {
+	checks := health.New(2 * time.Second)
+
+	//can we reach postgres at all?
+	checks.Register("database", func(ctx context.Context) (map[string]any, error) {
+		return nil, db.PingContext(ctx)
+	})
+
+	//has the schema been migrated to the version this build expects?
+	checks.Register("migrations", func(ctx context.Context) (map[string]any, error) {
+		current, dirty, err := models.Migrations.Version(ctx)
+		if err != nil {
+			return nil, err
+		}
+		details := map[string]any{
+			"current":  current,
+			"expected": data.SchemaVersion,
+			"dirty":    dirty,
+		}
+		switch {
+		case dirty:
+			return details, errors.New("last migration failed and left the schema dirty")
+		case current < data.SchemaVersion:
+			return details, fmt.Errorf("schema is at version %d, expected %d", current, data.SchemaVersion)
+		}
+		return details, nil
+	})
+
+	//are requests queueing for a connection? A pool that is merely full is
+	//fine, so this only fails when the requests that waited since the last
+	//run waited long on average
+	var mu sync.Mutex
+	var last sql.DBStats
+	checks.Register("connection_pool", func(ctx context.Context) (map[string]any, error) {
+		stats := db.Stats()
+		mu.Lock()
+		waits := stats.WaitCount - last.WaitCount
+		waited := stats.WaitDuration - last.WaitDuration
+		last = stats
+		mu.Unlock()
+		details := map[string]any{
+			"open":          stats.OpenConnections,
+			"in_use":        stats.InUse,
+			"idle":          stats.Idle,
+			"max_open":      stats.MaxOpenConnections,
+			"wait_count":    stats.WaitCount,
+			"wait_duration": stats.WaitDuration.String(),
+			"recent_waits":  waits,
+		}
+		if waits > 0 {
+			average := waited / time.Duration(waits)
+			details["recent_average_wait"] = average.String()
+			if average >= poolWaitThreshold {
+				return details, fmt.Errorf("requests waited %s on average for a connection", average.Round(time.Millisecond))
+			}
+		}
+		return details, nil
+	})
+
+	return checks
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/kirwadee/appletree/internal/tracing"
 	"github.com/kirwadee/appletree/internal/validator"
 )
 
@@ -29,14 +33,32 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
-// writeJSON method converts data passed to it to JSON response
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+// readInt64Param method reads a positive integer route parameter such as attachment_id
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	value, err := strconv.ParseInt(params.ByName(name), 10, 64)
+	if err != nil || value < 1 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+	return value, nil
+}
+
+// writeJSON method converts data passed to it to JSON response. The encoding and
+// writing are traced as their own span so they can be told apart from the queries
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) (err error) {
+	_, span := tracing.StartSpan(r.Context(), "encode_json")
+	defer func() {
+		span.RecordError(err)
+		span.Finish()
+	}()
+
 	jsData, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
 		return err
 	}
 	//add a new line to make viewing on the terminal easier
 	jsData = append(jsData, '\n')
+	span.SetAttribute("http.response_size", len(jsData))
 
 	//Add the headers while iterating bcoz its a map
 	for key, value := range headers {
@@ -147,3 +169,50 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	}
 	return intValue
 }
+
+// The readFloat() method converts a string value from the query string to a float value
+// if the value cannot be converted to a number then validation error is added to the validation errors map
+func (app *application) readFloat(qs url.Values, key string, defaultValue float64, v *validator.Validator) float64 {
+	value := qs.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+	return floatValue
+}
+
+// The readBool() method converts a string value from the query string to a boolean value
+// if the value cannot be converted to a boolean then validation error is added to the validation errors map
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	value := qs.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return boolValue
+}
+
+// The remoteIP() method returns the IP address of the client that sent the request
+func (app *application) remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// The randomHex() function returns n random bytes encoded as hex, used for
+// request IDs and blob keys
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
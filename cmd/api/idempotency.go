@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jsonlog"
+)
+
+// idempotencyLease is how long a request may hold an Idempotency-Key before a
+// retry can take it over. It is well past the server's WriteTimeout, so by then
+// the holder must have died without releasing the key
+const idempotencyLease = 2 * time.Minute
+
+// replayedHeaders are the response headers stored with an Idempotency-Key and
+// sent again when the response is replayed
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// The idempotency() middleware makes POST requests that carry an
+// Idempotency-Key header safe to retry. The first request with a key runs and
+// its response is stored. A retry of the same request gets that response back
+// without running again, or 409 Conflict if the first one hasn't finished,
+// while reusing the key for a different request gets 422. A 5xx response isn't
+// stored so the request can be retried with the same key
+func (app *application) idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key must not be more than 255 bytes long"))
+			return
+		}
+
+		//an attachment upload is spooled here before its handler runs, so give it the same time to arrive
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			if err := app.extendTransferDeadlines(w); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		//fingerprint the body while spooling it for the handler, attachment uploads are the largest we accept
+		maxBytes := int64(app.config.storage.maxAttachmentSize)*1024*1024 + 64*1024
+		h := newRequestFingerprint(r)
+		body, err := spoolBody(io.TeeReader(http.MaxBytesReader(w, r.Body, maxBytes), h))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", maxBytes))
+				return
+			}
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		defer body.Close()
+		r.Body = body
+		fingerprint := hex.EncodeToString(h.Sum(nil))
+
+		stored, acquired, err := app.models.Idempotency.Acquire(r.Context(), key, fingerprint, app.config.idempotency.retention, idempotencyLease)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.idempotencyKeyInUseResponse(w, r)
+			return
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		case acquired:
+		case stored.Fingerprint != fingerprint:
+			app.idempotencyKeyMismatchResponse(w, r)
+			return
+		case !stored.Completed():
+			app.idempotencyKeyInUseResponse(w, r)
+			return
+		default:
+			replayResponse(w, stored)
+			return
+		}
+
+		//finish with the key even if the client has gone away
+		ctx := context.WithoutCancel(r.Context())
+		completed := false
+		defer func() {
+			//the handler failed or panicked, so let the request be retried
+			if !completed {
+				if err := app.models.Idempotency.Release(ctx, key); err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+
+		rw := newRecordingResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		if rw.statusCode >= http.StatusInternalServerError {
+			return
+		}
+		header := make(http.Header)
+		for _, name := range replayedHeaders {
+			if values := rw.Header().Values(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		err = app.models.Idempotency.Complete(ctx, key, rw.statusCode, header, rw.body.Bytes())
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		completed = true
+	})
+}
+
+// newRequestFingerprint() starts the hash of what makes a request the same
+// request: its method, URL, content type and then the body written to it
+func newRequestFingerprint(r *http.Request) hash.Hash {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"))
+	return h
+}
+
+// spoolMemoryLimit is the largest body spoolBody() keeps in memory, the same
+// as the limit on JSON bodies
+const spoolMemoryLimit = 1_048_576
+
+// spoolBody() reads a request body to the end so it can be handed on to the
+// handler. Bodies up to spoolMemoryLimit are kept in memory, larger ones such
+// as attachment uploads go to a temporary file that is removed on Close()
+func spoolBody(src io.Reader) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, src, spoolMemoryLimit+1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n <= spoolMemoryLimit {
+		return io.NopCloser(&buf), nil
+	}
+	f, err := os.CreateTemp("", "appletree-body-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledFile{f}
+	_, err = io.Copy(f, io.MultiReader(&buf, src))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// spooledFile is a request body spooled to a temporary file
+type spooledFile struct {
+	*os.File
+}
+
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// replayResponse() writes a stored response again, marked as a replay
+func replayResponse(w http.ResponseWriter, stored *data.IdempotencyKey) {
+	for name, values := range stored.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+// recordingResponseWriter wraps http.ResponseWriter to keep a copy of the
+// status code and body written through it
+type recordingResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	body          bytes.Buffer
+	headerWritten bool
+}
+
+func newRecordingResponseWriter(w http.ResponseWriter) *recordingResponseWriter {
+	return &recordingResponseWriter{
+		wrapped:    w,
+		statusCode: http.StatusOK,
+	}
+}
+
+func (rw *recordingResponseWriter) Header() http.Header {
+	return rw.wrapped.Header()
+}
+
+func (rw *recordingResponseWriter) WriteHeader(statusCode int) {
+	rw.wrapped.WriteHeader(statusCode)
+	if !rw.headerWritten {
+		rw.statusCode = statusCode
+		rw.headerWritten = true
+	}
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	rw.headerWritten = true
+	rw.body.Write(b)
+	return rw.wrapped.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying ResponseWriter
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.wrapped
+}
+
+// The pruneIdempotencyKeys() method removes expired Idempotency-Keys every hour.
+// Until then an expired key is treated as unused, so this only reclaims space
+func (app *application) pruneIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed, err := app.models.Idempotency.DeleteExpired(context.Background(), time.Now().Add(-app.config.idempotency.retention))
+		if err != nil {
+			app.logger.Error(err)
+			continue
+		}
+		if removed > 0 {
+			app.logger.Info("pruned expired idempotency keys", jsonlog.Int64("removed", removed))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jobs"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// The registerJobs() method adds a handler for every kind of background job
+func (app *application) registerJobs() {
+	jobs.Register(app.jobs, thumbnailJob, app.generateThumbnail)
+	jobs.Register(app.jobs, webhookEventJob, app.fanOutEvent)
+	jobs.Register(app.jobs, webhookDeliveryJob, app.deliverWebhook)
+}
+
+// listJobsHandler for the GET "/v1/admin/jobs" endpoint. It reports the number
+// of jobs of each kind in each state along with a page of the jobs themselves,
+// which can be filtered by status and kind
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		Kind   string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Status = app.readString(qs, "status", "")
+	input.Kind = app.readString(qs, "kind", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "id"
+	input.Filters.SortList = []string{"id"}
+	v.Check(input.Status == "" || validator.In(input.Status, data.JobStatuses...), "status", "must be pending, running, done or dead")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stats, err := app.models.Jobs.Stats(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	list, metadata, err := app.models.Jobs.GetAll(r.Context(), input.Status, input.Kind, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	dispatcher := envelope{
+		"concurrency": app.jobs.Concurrency(),
+		"running":     app.jobs.Running(),
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"dispatcher": dispatcher, "queues": stats, "jobs": list, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// retryJobHandler for the POST "/v1/admin/jobs/:id/retry" endpoint. It puts a
+// dead-lettered job back on the queue
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	job, err := app.models.Jobs.Requeue(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
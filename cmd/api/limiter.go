@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiter keeps a token bucket rate limiter for each client IP address
+type clientLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// The newClientLimiter() function creates a clientLimiter and starts a
+// background goroutine that forgets clients we haven't seen for three minutes
+func newClientLimiter() *clientLimiter {
+	cl := &clientLimiter{clients: make(map[string]*client)}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			cl.mu.Lock()
+			for ip, c := range cl.clients {
+				if time.Since(c.lastSeen) > 3*time.Minute {
+					delete(cl.clients, ip)
+				}
+			}
+			cl.mu.Unlock()
+		}
+	}()
+	return cl
+}
+
+// allow() reports whether the client may make another request under the given limits
+func (cl *clientLimiter) allow(ip string, rps float64, burst int) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	c, found := cl.clients[ip]
+	if !found {
+		c = &client{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		cl.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter.Allow()
+}
+
+// reset() forgets every client so that new limits apply straight away
+func (cl *clientLimiter) reset() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.clients = make(map[string]*client)
+}
@@ -3,55 +3,77 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/health"
+	"github.com/kirwadee/appletree/internal/jobs"
 	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/kirwadee/appletree/internal/storage"
+	"github.com/kirwadee/appletree/internal/tracing"
 	_ "github.com/lib/pq"
 )
 
-// application version number
-const (
-	version = "1.0.0"
-)
-
-// The configuration settings
-type config struct {
-	port int
-	env  string //development, production, staging
-	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  string
-	}
-}
-
 // Dependency Injection
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
+	config    config
+	logger    *jsonlog.Logger
+	models    data.Models
+	metrics   *appMetrics
+	tracer    *tracing.Tracer
+	health    *health.Registry
+	settings  atomic.Pointer[runtimeSettings]
+	limiter   *clientLimiter
+	blobs     storage.BlobStore
+	jobs      *jobs.Dispatcher
+	changes   *changeBroker
+	startedAt time.Time
 }
 
 func main() {
-	var cfg config
-	//read in flags that are needed to populate config struct
-	flag.IntVar(&cfg.port, "port", 4000, "API Server Port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment(development | staging | production)")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("APPLETREE_DB_DSN"), "Postgresql dsn")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "Postgresql max open conns")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "Postgresql max idle conns")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "Postgresql max connection idle time")
-	flag.Parse()
+	startedAt := time.Now()
+	//read the configuration from the config file, environment and flags
+	cfg, actions, _, err := loadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	//print the build metadata and exit
+	if actions.displayVersion {
+		printVersion()
+		os.Exit(0)
+	}
+
+	//print the effective configuration and exit
+	if actions.printConfig {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	//Create a customized logger instance
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	logger, err := openLogger(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	//route log/slog, and the standard log package, through the same logger
+	slog.SetDefault(slog.New(logger))
 
 	//create a connection pool
 	db, err := openDB(cfg)
@@ -61,38 +83,113 @@ func main() {
 	defer db.Close()
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
 	db.SetMaxIdleConns(cfg.db.maxIdleConns)
-	duration, _ := time.ParseDuration(cfg.db.maxIdleTime)
-
-	db.SetConnMaxIdleTime(duration)
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
 	logger.PrintInfo("Connected to postgres db", nil)
 
+	//set up the span exporter
+	tracer, err := openTracer(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	//attachments are kept on the local filesystem
+	blobs, err := storage.NewLocalStore(cfg.storage.dir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	//Create an instance of application struct
+	models := data.NewModels(db)
+	//stream school changes to subscribers as they are notified
+	changes, err := openChangeBroker(cfg, models.Changes, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
+		config:    cfg,
+		logger:    logger,
+		models:    models,
+		metrics:   newAppMetrics(db),
+		tracer:    tracer,
+		health:    newHealthChecks(db, models),
+		limiter:   newClientLimiter(),
+		blobs:     blobs,
+		changes:   changes,
+		startedAt: startedAt,
 	}
-
-	//create our server ServeMux
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/healthcheck", app.healthcheckHandler)
+	app.settings.Store(newRuntimeSettings(cfg))
+	//background jobs are claimed from the jobs table and run once their handlers are registered
+	app.jobs = jobs.New(models.Jobs, logger, tracer, jobs.Options{
+		Concurrency:  cfg.jobs.concurrency,
+		PollInterval: cfg.jobs.pollInterval,
+		Timeout:      cfg.jobs.timeout,
+		MaxAttempts:  cfg.jobs.maxAttempts,
+		Retention:    cfg.jobs.retention,
+	})
+	app.registerJobs()
+	app.jobs.Start()
+	//apply log level, rate limit and maintenance changes on SIGHUP
+	go app.handleReloads()
+	go app.pruneIdempotencyKeys()
 
 	//create a http server
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.port),
 		Handler:      app.routes(),
-		ErrorLog:     log.New(logger, "", 0),
+		ErrorLog:     slog.NewLogLogger(logger, slog.LevelError),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	//open change streams would otherwise hold up a graceful shutdown
+	srv.RegisterOnShutdown(app.changes.close)
+	//serve the metrics on their own admin port if one was given
+	if cfg.metrics.port != 0 {
+		go app.serveMetrics()
+	}
+	//serve HTTPS, and with it HTTP/2, when a certificate has been configured
+	if cfg.tls.certFile != "" {
+		certs, err := newCertReloader(cfg.tls.certFile, cfg.tls.keyFile, cfg.tls.clientCAFile, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		srv.TLSConfig, err = tlsConfig(certs, cfg.tls.clientAuth)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
 	//start our server
 	logger.PrintInfo("Starting server", map[string]string{
+		"addr":       srv.Addr,
+		"env":        cfg.env,
+		"tls":        strconv.FormatBool(srv.TLSConfig != nil),
+		"version":    version,
+		"commit":     buildCommit(),
+		"build_time": buildTimestamp(),
+	})
+	err = app.serve(srv)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+}
+
+// The serveMetrics() method serves /metrics on the admin port
+func (app *application) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", app.metrics.registry.Handler())
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.metrics.port),
+		Handler:      mux,
+		ErrorLog:     slog.NewLogLogger(app.logger, slog.LevelError),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	app.logger.PrintInfo("Starting metrics server", map[string]string{
 		"addr": srv.Addr,
-		"env":  cfg.env,
 	})
-	err = srv.ListenAndServe()
-	logger.PrintFatal(err, nil)
+	err := srv.ListenAndServe()
+	app.logger.PrintFatal(err, nil)
 }
 
 // The openDB() returns pointer to *sql.DB connection pool
@@ -111,3 +208,54 @@ func openDB(cf config) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+// The openTracer() function creates a tracer for the configured exporter.
+// It returns a nil tracer, which records nothing, when tracing is disabled
+func openTracer(cf config, logger *jsonlog.Logger) (*tracing.Tracer, error) {
+	const service = "appletree"
+	logger = logger.With(jsonlog.String("component", "tracing"))
+	onError := func(err error) {
+		logger.Error(err)
+	}
+	switch cf.trace.exporter {
+	case "none", "":
+		return nil, nil
+	case "stdout":
+		return tracing.New(service, tracing.NewWriterExporter(os.Stdout, service, onError)), nil
+	case "file":
+		f, err := os.OpenFile(cf.trace.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return tracing.New(service, tracing.NewWriterExporter(f, service, onError)), nil
+	case "otlp":
+		return tracing.New(service, tracing.NewOTLPExporter(cf.trace.endpoint, service, onError)), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cf.trace.exporter)
+	}
+}
+
+// The openLogger() function creates the application logger from the log settings
+func openLogger(cf config) (*jsonlog.Logger, error) {
+	level, err := jsonlog.ParseLevel(cf.log.level)
+	if err != nil {
+		return nil, err
+	}
+	var out io.Writer = os.Stdout
+	if cf.log.file != "" {
+		out = &jsonlog.RotatingFile{
+			Filename:   cf.log.file,
+			MaxSize:    int64(cf.log.maxSize) * 1024 * 1024,
+			Interval:   cf.log.rotateInterval,
+			MaxBackups: cf.log.maxBackups,
+		}
+	}
+	var opts []jsonlog.Option
+	if cf.log.stackTraces {
+		opts = append(opts, jsonlog.WithStackTraces())
+	}
+	if cf.log.sampleFirst > 0 {
+		opts = append(opts, jsonlog.WithSampling(time.Second, cf.log.sampleFirst, cf.log.sampleThereafter))
+	}
+	return jsonlog.New(out, level, opts...), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// errMergeInvalid rolls back a merge whose result fails validation
+var errMergeInvalid = errors.New("merged school is invalid")
+
+// listDuplicatesHandler for the GET "/v1/schools/duplicates" endpoint. It lists
+// pairs of schools that look like the same school, most likely first, for
+// someone to review and merge
+func (app *application) listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MinSimilarity float64
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.MinSimilarity = app.readFloat(qs, "min_similarity", data.MinDuplicateSimilarity, v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "score"
+	input.Filters.SortList = []string{"score"}
+	v.Check(input.MinSimilarity >= data.MinDuplicateSimilarity && input.MinSimilarity <= 1, "min_similarity", fmt.Sprintf("must be between %g and 1", data.MinDuplicateSimilarity))
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	candidates, metadata, err := app.models.Schools.FindDuplicates(r.Context(), input.MinSimilarity, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"duplicates": candidates, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// mergeSchoolsHandler for the POST "/v1/schools/merge" endpoint. The loser is
+// merged into the winner: the winner keeps its details and takes whatever it
+// is missing from the loser, the loser's attachments, campuses and programs
+// move over and the loser is deleted. Both schools are snapshotted as
+// revisions first, and requests for the loser's id are redirected to the
+// winner from then on. Both versions must be given so nobody merges schools
+// that changed since they were reviewed
+func (app *application) mergeSchoolsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		WinnerID      int64  `json:"winner_id"`
+		WinnerVersion *int32 `json:"winner_version"`
+		LoserID       int64  `json:"loser_id"`
+		LoserVersion  *int32 `json:"loser_version"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.WinnerID > 0, "winner_id", "must be provided")
+	v.Check(input.WinnerVersion != nil, "winner_version", "must be provided")
+	v.Check(input.LoserID > 0, "loser_id", "must be provided")
+	v.Check(input.LoserVersion != nil, "loser_version", "must be provided")
+	v.Check(input.LoserID != input.WinnerID, "loser_id", "must be different from winner_id")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx := r.Context()
+	var winner *data.School
+	err = app.transaction(ctx, func(tx data.Models) error {
+		var err error
+		winner, err = tx.Schools.Get(ctx, input.WinnerID)
+		if err != nil {
+			return err
+		}
+		loser, err := tx.Schools.Get(ctx, input.LoserID)
+		if err != nil {
+			return err
+		}
+		if winner.Version != *input.WinnerVersion || loser.Version != *input.LoserVersion {
+			return data.ErrEditConflict
+		}
+		if err = tx.Schools.InsertRevision(ctx, winner, data.RevisionBeforeMerge); err != nil {
+			return err
+		}
+		if err = tx.Schools.InsertRevision(ctx, loser, data.RevisionMerged); err != nil {
+			return err
+		}
+
+		mergeSchool(winner, loser)
+		if data.ValidateSchool(v, winner); !v.Valid() {
+			return errMergeInvalid
+		}
+		if _, err = tx.Attachments.MoveAll(ctx, loser.ID, winner.ID); err != nil {
+			return err
+		}
+		if _, err = tx.Campuses.MoveAll(ctx, loser.ID, winner.ID); err != nil {
+			return err
+		}
+		if _, err = tx.Programs.MoveAll(ctx, loser.ID, winner.ID); err != nil {
+			return err
+		}
+		//redirect the loser before deleting it, as deleting it removes the redirects that point at it
+		if err = tx.Schools.RecordMerge(ctx, loser.ID, winner.ID); err != nil {
+			return err
+		}
+		if err = tx.Schools.DeleteVersion(ctx, loser.ID, loser.Version); err != nil {
+			return err
+		}
+		//the loser is gone, so the winner can take over its external ID
+		if err = tx.Schools.Update(ctx, winner); err != nil {
+			return err
+		}
+		if err = app.emitEvent(ctx, tx, "school.updated", envelope{"school": winner}); err != nil {
+			return err
+		}
+		return app.emitEvent(ctx, tx, "school.deleted", envelope{"school": envelope{"id": loser.ID, "merged_into": winner.ID}})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, errMergeInvalid):
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"school": winner, "merged_id": input.LoserID}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// mergeSchool() fills in what the winner is missing from the loser: an empty
+// email, website or external ID, and any modes it doesn't offer yet, up to the
+// five a school may have
+func mergeSchool(winner, loser *data.School) {
+	if winner.Email == "" {
+		winner.Email = loser.Email
+	}
+	if winner.Website == "" {
+		winner.Website = loser.Website
+	}
+	if winner.ExternalID == "" {
+		winner.ExternalID = loser.ExternalID
+	}
+	for _, mode := range loser.Mode {
+		if len(winner.Mode) < 5 && !slices.Contains(winner.Mode, mode) {
+			winner.Mode = append(winner.Mode, mode)
+		}
+	}
+}
+
+// listRevisionsHandler for the GET "/v1/schools/:id/revisions" endpoint. It
+// returns the snapshots taken of the school, and of the schools merged into
+// it, newest first
+func (app *application) listRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	revisions, err := app.models.Schools.GetRevisions(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"revisions": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The mergedSchoolResponse() method answers a request for a school that no
+// longer exists. If it was merged away the client is redirected to the school
+// it was merged into, otherwise it gets 404
+func (app *application) mergedSchoolResponse(w http.ResponseWriter, r *http.Request, id int64) {
+	intoID, err := app.models.Schools.MergedInto(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	location := fmt.Sprintf("/v1/schools/%d", intoID)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	headers := make(http.Header)
+	headers.Set("Location", location)
+	err = app.writeJSON(w, r, http.StatusMovedPermanently, envelope{"merged_into": intoID}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/kirwadee/appletree/internal/metrics"
+)
+
+// appMetrics groups the metrics recorded by the HTTP middleware
+type appMetrics struct {
+	registry     *metrics.Registry
+	requests     *metrics.CounterVec
+	duration     *metrics.HistogramVec
+	responseSize *metrics.HistogramVec
+}
+
+// The newAppMetrics() function creates the metrics registry, including the
+// database pool and Go runtime collectors
+func newAppMetrics(db *sql.DB) *appMetrics {
+	registry := metrics.NewRegistry()
+	m := &appMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("http_requests_total",
+			"Total number of HTTP requests processed.", "method", "route", "status"),
+		duration: registry.NewHistogramVec("http_request_duration_seconds",
+			"Time taken to process HTTP requests.", metrics.DefBuckets, "method", "route", "status"),
+		responseSize: registry.NewHistogramVec("http_response_size_bytes",
+			"Size of HTTP response bodies.", []float64{100, 1_000, 10_000, 100_000, 1_000_000}, "method", "route", "status"),
+	}
+	registry.Register(metrics.NewDBStatsCollector(db))
+	registry.Register(metrics.NewRuntimeCollector())
+	return m
+}
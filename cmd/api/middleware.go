@@ -3,6 +3,12 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/kirwadee/appletree/internal/tracing"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -16,3 +22,243 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// The serverHeader() middleware identifies the API build in the Server response header
+func (app *application) serverHeader(next http.Handler) http.Handler {
+	server := "appletree/" + version
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", server)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requestID() middleware accepts the client's X-Request-ID header, or generates
+// a new ID, stores it in the request context and echoes it in the response
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = randomHex(16)
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID() reports whether a client supplied request ID is safe to log and echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// The trace() middleware starts a server span for every request, continuing the
+// caller's trace when a W3C traceparent header is present
+func (app *application) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.ContextWithRemoteParent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := app.tracer.Start(ctx, r.Method, tracing.KindServer)
+		defer span.Finish()
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r.WithContext(ctx))
+
+		route := ""
+		if info := app.contextGetRouteInfo(r); info != nil {
+			route = info.pattern
+		}
+		if route != "" {
+			span.SetName(r.Method + " " + route)
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("http.status_code", mw.statusCode)
+		span.SetAttribute("http.response_size", mw.bytesWritten)
+		span.SetAttribute("request_id", app.contextGetRequestID(r))
+		if mw.statusCode >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", mw.statusCode, http.StatusText(mw.statusCode)))
+		}
+	})
+}
+
+// The logRequest() middleware writes a structured access log line for every request
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		app.logger.InfoContext(r.Context(), "request completed",
+			jsonlog.String("method", r.Method),
+			jsonlog.String("url", r.URL.RequestURI()),
+			jsonlog.String("proto", r.Proto),
+			jsonlog.Int("status", mw.statusCode),
+			jsonlog.Int("bytes", mw.bytesWritten),
+			jsonlog.Duration("duration", time.Since(start)),
+			jsonlog.String("remote_ip", app.remoteIP(r)),
+			jsonlog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
+
+// The rateLimit() middleware limits how often each client IP address may call
+// the API, using the limits from the current runtime settings
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := app.settings.Load()
+		if settings.limiter.enabled && !app.limiter.allow(app.remoteIP(r), settings.limiter.rps, settings.limiter.burst) {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The maintenance() middleware answers API requests with 503 Service Unavailable
+// while maintenance mode is on. Healthchecks and metrics keep working
+func (app *application) maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.settings.Load().maintenance && !strings.HasPrefix(r.URL.Path, "/v1/healthcheck") && r.URL.Path != "/metrics" {
+			app.maintenanceResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The enableCORS() middleware lets browsers on trusted origins call the API.
+// It answers preflight requests itself, before httprouter's automatic OPTIONS
+// handling, advertising the methods registered for the requested path
+func (app *application) enableCORS(allowedMethods func(path string) []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+		settings := app.settings.Load()
+		if origin != "" && trustedOrigin(origin, settings.cors.trustedOrigins) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			//preflight requests are OPTIONS requests with an Access-Control-Request-Method header
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				methods := allowedMethods(r.URL.Path)
+				if len(methods) == 0 {
+					app.notFoundResponse(w, r)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key")
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(settings.cors.maxAge.Seconds())))
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trustedOrigin() reports whether origin is in the trusted list. A "*" entry trusts every origin
+func trustedOrigin(origin string, trusted []string) bool {
+	for _, t := range trusted {
+		if t == "*" || t == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsResponseWriter wraps http.ResponseWriter to record the status code
+// and the number of bytes written
+type metricsResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	bytesWritten  int
+	headerWritten bool
+}
+
+func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
+	return &metricsResponseWriter{
+		wrapped:    w,
+		statusCode: http.StatusOK,
+	}
+}
+
+func (mw *metricsResponseWriter) Header() http.Header {
+	return mw.wrapped.Header()
+}
+
+func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
+	mw.wrapped.WriteHeader(statusCode)
+	if !mw.headerWritten {
+		mw.statusCode = statusCode
+		mw.headerWritten = true
+	}
+}
+
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	mw.headerWritten = true
+	n, err := mw.wrapped.Write(b)
+	mw.bytesWritten += n
+	return n, err
+}
+
+// Unwrap() lets http.ResponseController reach the underlying ResponseWriter
+func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return mw.wrapped
+}
+
+// The recordMetrics() middleware records request counts, latencies and response
+// sizes labelled by the matched route pattern rather than the raw URL
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &routeInfo{}
+		r = app.contextSetRouteInfo(r, info)
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		route := info.pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		method := metricsMethod(r.Method)
+		status := strconv.Itoa(mw.statusCode)
+		app.metrics.requests.Inc(method, route, status)
+		app.metrics.duration.Observe(time.Since(start).Seconds(), method, route, status)
+		app.metrics.responseSize.Observe(float64(mw.bytesWritten), method, route, status)
+	})
+}
+
+// metricsMethod() returns the method label for a request. Clients can send any
+// token as a method, so anything but the standard methods is counted as "other"
+// to keep the number of series bounded
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// The route() method wraps a handler so that the route pattern it was
+// registered under is recorded in the request's routeInfo
+func (app *application) route(pattern string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := app.contextGetRouteInfo(r); info != nil {
+			info.pattern = pattern
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// listProgramsHandler for the GET "/v1/schools/:id/programs" endpoint
+func (app *application) listProgramsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	programs, err := app.models.Programs.GetAllForSchool(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"programs": programs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createProgramHandler for the POST "/v1/schools/:id/programs" endpoint
+func (app *application) createProgramHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input struct {
+		Name      string `json:"name"`
+		MinAge    int    `json:"min_age"`
+		MaxAge    int    `json:"max_age"`
+		Capacity  int    `json:"capacity"`
+		Enrolled  int    `json:"enrolled"`
+		Fees      int64  `json:"fees"`
+		TermStart string `json:"term_start"`
+		TermEnd   string `json:"term_end"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	program := &data.Program{
+		SchoolID:  id,
+		Name:      input.Name,
+		MinAge:    input.MinAge,
+		MaxAge:    input.MaxAge,
+		Capacity:  input.Capacity,
+		Enrolled:  input.Enrolled,
+		Fees:      input.Fees,
+		TermStart: input.TermStart,
+		TermEnd:   input.TermEnd,
+	}
+	v := validator.New()
+	if data.ValidateProgram(v, program); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Programs.Insert(r.Context(), program)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/schools/%d/programs/%d", id, program.ID))
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"program": program}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showProgramHandler for the GET "/v1/schools/:id/programs/:program_id" endpoint
+func (app *application) showProgramHandler(w http.ResponseWriter, r *http.Request) {
+	program, ok := app.readProgram(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"program": program}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateProgramHandler for the PATCH "/v1/schools/:id/programs/:program_id" endpoint.
+// Fields left out of the body keep their values, so enrolled can be updated on its own
+func (app *application) updateProgramHandler(w http.ResponseWriter, r *http.Request) {
+	program, ok := app.readProgram(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Name      *string `json:"name"`
+		MinAge    *int    `json:"min_age"`
+		MaxAge    *int    `json:"max_age"`
+		Capacity  *int    `json:"capacity"`
+		Enrolled  *int    `json:"enrolled"`
+		Fees      *int64  `json:"fees"`
+		TermStart *string `json:"term_start"`
+		TermEnd   *string `json:"term_end"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Name != nil {
+		program.Name = *input.Name
+	}
+	if input.MinAge != nil {
+		program.MinAge = *input.MinAge
+	}
+	if input.MaxAge != nil {
+		program.MaxAge = *input.MaxAge
+	}
+	if input.Capacity != nil {
+		program.Capacity = *input.Capacity
+	}
+	if input.Enrolled != nil {
+		program.Enrolled = *input.Enrolled
+	}
+	if input.Fees != nil {
+		program.Fees = *input.Fees
+	}
+	if input.TermStart != nil {
+		program.TermStart = *input.TermStart
+	}
+	if input.TermEnd != nil {
+		program.TermEnd = *input.TermEnd
+	}
+	v := validator.New()
+	if data.ValidateProgram(v, program); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Programs.Update(r.Context(), program)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"program": program}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteProgramHandler for the DELETE "/v1/schools/:id/programs/:program_id" endpoint
+func (app *application) deleteProgramHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	programID, err := app.readInt64Param(r, "program_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Programs.Delete(r.Context(), id, programID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "program successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readProgram() method looks up the program named by the route,
+// sending a 404 or 500 response and returning false if it can't
+func (app *application) readProgram(w http.ResponseWriter, r *http.Request) (*data.Program, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	programID, err := app.readInt64Param(r, "program_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	program, err := app.models.Programs.Get(r.Context(), id, programID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return program, true
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/kirwadee/appletree/internal/validator"
 )
 
 func (app *application) routes() http.Handler {
@@ -12,13 +13,107 @@ func (app *application) routes() http.Handler {
 	//customize NotFound field in router struct
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	//httprouter can't match a static segment where a wildcard is registered,
+	//so paths like /v1/schools/stream go on a second router that is tried first
+	fixed := httprouter.New()
+	fixed.NotFound = router.NotFound
+	fixed.MethodNotAllowed = router.MethodNotAllowed
+	//register adds a handler and records its route pattern for the metrics
+	//along with its method for CORS preflight responses
+	var methods []string
+	register := func(rt *httprouter.Router, method, pattern string, handler http.HandlerFunc) {
+		rt.Handler(method, pattern, app.route(pattern, handler))
+		if !validator.In(method, methods...) {
+			methods = append(methods, method)
+		}
+	}
+	handle := func(method, pattern string, handler http.HandlerFunc) {
+		register(router, method, pattern, handler)
+	}
+	handleFixed := func(method, pattern string, handler http.HandlerFunc) {
+		register(fixed, method, pattern, handler)
+	}
 	//handlers
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/schools", app.listSchoolsHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/schools", app.createSchoolHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/schools/:id", app.showSchoolHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/schools/:id", app.updateSchoolHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/schools/:id", app.deleteSchoolHandler)
+	handle(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck/live", app.liveHealthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck/ready", app.readyHealthcheckHandler)
+	handle(http.MethodGet, "/v1/schools", app.listSchoolsHandler)
+	handle(http.MethodPost, "/v1/schools", app.createSchoolHandler)
+	handleFixed(http.MethodGet, "/v1/schools/stream", app.streamSchoolsHandler)
+	handleFixed(http.MethodGet, "/v1/schools/changes", app.listSchoolChangesHandler)
+	handleFixed(http.MethodPost, "/v1/schools/batch", app.batchSchoolsHandler)
+	handleFixed(http.MethodPut, "/v1/schools/by-external-id/:code", app.upsertSchoolHandler)
+	handleFixed(http.MethodGet, "/v1/schools/duplicates", app.listDuplicatesHandler)
+	handleFixed(http.MethodPost, "/v1/schools/merge", app.mergeSchoolsHandler)
+	handle(http.MethodGet, "/v1/schools/:id", app.showSchoolHandler)
+	handle(http.MethodPatch, "/v1/schools/:id", app.updateSchoolHandler)
+	handle(http.MethodPut, "/v1/schools/:id", app.replaceSchoolHandler)
+	handle(http.MethodDelete, "/v1/schools/:id", app.deleteSchoolHandler)
+	handle(http.MethodGet, "/v1/schools/:id/revisions", app.listRevisionsHandler)
+	handle(http.MethodGet, "/v1/schools/:id/attachments", app.listAttachmentsHandler)
+	handle(http.MethodPost, "/v1/schools/:id/attachments", app.createAttachmentHandler)
+	handle(http.MethodGet, "/v1/schools/:id/attachments/:attachment_id", app.showAttachmentHandler)
+	handle(http.MethodDelete, "/v1/schools/:id/attachments/:attachment_id", app.deleteAttachmentHandler)
+	handle(http.MethodGet, "/v1/schools/:id/attachments/:attachment_id/thumbnail", app.showThumbnailHandler)
+	handle(http.MethodGet, "/v1/schools/:id/campuses", app.listCampusesHandler)
+	handle(http.MethodPost, "/v1/schools/:id/campuses", app.createCampusHandler)
+	handle(http.MethodGet, "/v1/schools/:id/campuses/:campus_id", app.showCampusHandler)
+	handle(http.MethodPatch, "/v1/schools/:id/campuses/:campus_id", app.updateCampusHandler)
+	handle(http.MethodDelete, "/v1/schools/:id/campuses/:campus_id", app.deleteCampusHandler)
+	handle(http.MethodGet, "/v1/schools/:id/programs", app.listProgramsHandler)
+	handle(http.MethodPost, "/v1/schools/:id/programs", app.createProgramHandler)
+	handle(http.MethodGet, "/v1/schools/:id/programs/:program_id", app.showProgramHandler)
+	handle(http.MethodPatch, "/v1/schools/:id/programs/:program_id", app.updateProgramHandler)
+	handle(http.MethodDelete, "/v1/schools/:id/programs/:program_id", app.deleteProgramHandler)
+	handle(http.MethodGet, "/v1/schools/:id/hours", app.showOpeningHoursHandler)
+	handle(http.MethodPut, "/v1/schools/:id/hours", app.replaceOpeningHoursHandler)
+	handle(http.MethodGet, "/v1/schools/:id/closures", app.listClosuresHandler)
+	handle(http.MethodPost, "/v1/schools/:id/closures", app.createClosureHandler)
+	handle(http.MethodDelete, "/v1/schools/:id/closures/:closure_id", app.deleteClosureHandler)
+	handle(http.MethodGet, "/v1/webhooks", app.listWebhooksHandler)
+	handle(http.MethodPost, "/v1/webhooks", app.createWebhookHandler)
+	handle(http.MethodGet, "/v1/webhooks/:id", app.showWebhookHandler)
+	handle(http.MethodPatch, "/v1/webhooks/:id", app.updateWebhookHandler)
+	handle(http.MethodDelete, "/v1/webhooks/:id", app.deleteWebhookHandler)
+	handle(http.MethodGet, "/v1/webhooks/:id/deliveries", app.listDeliveriesHandler)
+	handle(http.MethodGet, "/v1/webhooks/:id/deliveries/:delivery_id", app.showDeliveryHandler)
+	handle(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/replay", app.replayDeliveryHandler)
+	handle(http.MethodGet, "/v1/admin/jobs", app.listJobsHandler)
+	handle(http.MethodPost, "/v1/admin/jobs/:id/retry", app.retryJobHandler)
+	//serve the metrics here unless they have their own admin port
+	if app.config.metrics.port == 0 {
+		handle(http.MethodGet, "/metrics", app.metrics.registry.Handler().ServeHTTP)
+	}
 
-	return app.recoverPanic(router)
+	//lookup returns the methods a router has registered for a path
+	lookup := func(rt *httprouter.Router, path string) []string {
+		var allowed []string
+		for _, method := range methods {
+			if handle, _, _ := rt.Lookup(method, path); handle != nil {
+				allowed = append(allowed, method)
+			}
+		}
+		return allowed
+	}
+	//allowedMethods lists the registered methods that match a path
+	allowedMethods := func(path string) []string {
+		allowed := lookup(fixed, path)
+		if len(allowed) == 0 {
+			allowed = lookup(router, path)
+		}
+		if len(allowed) > 0 {
+			allowed = append(allowed, http.MethodOptions)
+		}
+		return allowed
+	}
+	//dispatch sends a request to the fixed router when it owns the path
+	dispatch := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(lookup(fixed, r.URL.Path)) > 0 {
+			fixed.ServeHTTP(w, r)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+
+	return app.recordMetrics(app.requestID(app.trace(app.logRequest(app.serverHeader(app.recoverPanic(app.enableCORS(allowedMethods, app.maintenance(app.rateLimit(app.idempotency(dispatch))))))))))
 }
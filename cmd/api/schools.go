@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"slices"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jsonpatch"
 	"github.com/kirwadee/appletree/internal/validator"
 )
 
@@ -14,14 +21,16 @@ func (app *application) createSchoolHandler(w http.ResponseWriter, r *http.Reque
 	//client will create school as JSON object so it is upon the handler to convert it back to raw data
 	//our target decode destination
 	var input struct {
-		Name    string   `json:"name"`
-		Level   string   `json:"level"`
-		Contact string   `json:"contact"`
-		Phone   string   `json:"phone"`
-		Email   string   `json:"email"`
-		Website string   `json:"website"`
-		Address string   `json:"address"`
-		Mode    []string `json:"mode"`
+		Name       string   `json:"name"`
+		Level      string   `json:"level"`
+		Contact    string   `json:"contact"`
+		Phone      string   `json:"phone"`
+		Email      string   `json:"email"`
+		Website    string   `json:"website"`
+		Address    string   `json:"address"`
+		Mode       []string `json:"mode"`
+		TimeZone   string   `json:"time_zone"`
+		ExternalID string   `json:"external_id"`
 	}
 
 	//initialize a new json.Decoder instance
@@ -33,14 +42,16 @@ func (app *application) createSchoolHandler(w http.ResponseWriter, r *http.Reque
 
 	//copy the values from the input struct  to a new school struct
 	school := &data.School{
-		Name:    input.Name,
-		Level:   input.Level,
-		Contact: input.Contact,
-		Phone:   input.Phone,
-		Email:   input.Email,
-		Website: input.Website,
-		Address: input.Address,
-		Mode:    input.Mode,
+		Name:       input.Name,
+		Level:      input.Level,
+		Contact:    input.Contact,
+		Phone:      input.Phone,
+		Email:      input.Email,
+		Website:    input.Website,
+		Address:    input.Address,
+		Mode:       input.Mode,
+		TimeZone:   input.TimeZone,
+		ExternalID: input.ExternalID,
 	}
 	//initialize a new validator instance
 	v := validator.New()
@@ -50,17 +61,28 @@ func (app *application) createSchoolHandler(w http.ResponseWriter, r *http.Reque
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	//Insert into the database
-	err = app.models.Schools.Insert(school)
+	//Insert into the database, queueing the event in the same transaction
+	err = app.transaction(r.Context(), func(tx data.Models) error {
+		if err := tx.Schools.Insert(r.Context(), school); err != nil {
+			return err
+		}
+		return app.emitEvent(r.Context(), tx, "school.created", envelope{"school": school})
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateExternalID):
+			app.failedValidationResponse(w, r, duplicateExternalIDErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 	//create location header for the newly created resource/School
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/schools/%d", school.ID))
 	//write the JSON response with 201 status code
 	//with the body being the school data and the header being the headers map
-	err = app.writeJSON(w, http.StatusCreated, envelope{"school": school}, headers)
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"school": school}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -73,69 +95,88 @@ func (app *application) showSchoolHandler(w http.ResponseWriter, r *http.Request
 		app.notFoundResponse(w, r)
 		return
 	}
+	//the related resources to embed in the school
+	v := validator.New()
+	include := app.readCSV(r.URL.Query(), "include", []string{})
+	if validateIncludes(v, include); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
 	//Fetch the specific school
-	school, err := app.models.Schools.Get(id)
+	school, err := app.models.Schools.Get(r.Context(), id)
 	//Handle errors
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrorRecordNotFound):
-			app.notFoundResponse(w, r)
+			app.mergedSchoolResponse(w, r, id)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	var response any = school
+	if slices.Contains(include, "campuses") {
+		embedded, err := app.embedCampuses(r, school)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		response = embedded[0]
+	}
 	//write the data returned by Get()
-	err = app.writeJSON(w, http.StatusOK, envelope{"school": school}, nil)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"school": response}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) updateSchoolHandler(w http.ResponseWriter, r *http.Request) {
-	//This method does a partial  replacement
-	//Get the id of the school that needs updating
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
+// parseOpenAt() reads the open_at query parameter. A time without an offset,
+// such as 2026-10-20T09:00, is a clock time read in each school's time zone.
+// One with an offset, such as 2026-10-20T09:00:00Z, and "now" are instants
+func parseOpenAt(value string) (_ time.Time, local, ok bool) {
+	if value == "now" {
+		return time.Now(), false, true
 	}
-	//Fetch the original record from the database ie school
-	school, err := app.models.Schools.Get(id)
-	//Handle errors
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrorRecordNotFound):
-			app.notFoundResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, true
 	}
-	//create an input struct to hold data read in from the client request
-	//we update input struct to use pointers because pointers have default value of nil
-	//If a field remains nil then we know the client did not update it
-	var input struct {
-		Name    *string  `json:"name"`
-		Level   *string  `json:"level"`
-		Contact *string  `json:"contact"`
-		Phone   *string  `json:"phone"`
-		Email   *string  `json:"email"`
-		Website *string  `json:"website"`
-		Address *string  `json:"address"`
-		Mode    []string `json:"mode"`
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true, true
+		}
 	}
+	return time.Time{}, false, false
+}
 
-	//read data from client request and store it in &input struct as go values
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
+// schoolIncludes lists the related resources the include query parameter can embed in a school
+var schoolIncludes = []string{"campuses"}
+
+func validateIncludes(v *validator.Validator, include []string) {
+	for _, name := range include {
+		v.Check(validator.In(name, schoolIncludes...), "include", "must only contain campuses")
 	}
+}
+
+// schoolInput holds the school fields a client sends to change a school. The
+// fields are pointers because pointers have default value of nil, so if a
+// field remains nil then we know the client did not update it
+type schoolInput struct {
+	Name       *string  `json:"name"`
+	Level      *string  `json:"level"`
+	Contact    *string  `json:"contact"`
+	Phone      *string  `json:"phone"`
+	Email      *string  `json:"email"`
+	Website    *string  `json:"website"`
+	Address    *string  `json:"address"`
+	Mode       []string `json:"mode"`
+	TimeZone   *string  `json:"time_zone"`
+	ExternalID *string  `json:"external_id"`
+}
 
-	//check for updates
+// The apply() method copies the fields the client sent onto school
+func (input schoolInput) apply(school *data.School) {
 	if input.Name != nil {
 		school.Name = *input.Name
 	}
@@ -160,6 +201,148 @@ func (app *application) updateSchoolHandler(w http.ResponseWriter, r *http.Reque
 	if input.Mode != nil {
 		school.Mode = input.Mode
 	}
+	if input.TimeZone != nil {
+		school.TimeZone = *input.TimeZone
+	}
+	if input.ExternalID != nil {
+		school.ExternalID = *input.ExternalID
+	}
+}
+
+// schoolPatchTypes lists the content types PATCH "/v1/schools/:id" accepts
+const schoolPatchTypes = "application/json, " + jsonpatch.MergePatchType + ", " + jsonpatch.JSONPatchType
+
+// schoolDocument is the whole of a school a client can change. It is the body
+// of a PUT and what a patch document applies to. Optional fields are left out
+// when empty so a patch sees them as absent
+type schoolDocument struct {
+	Name       string   `json:"name"`
+	Level      string   `json:"level"`
+	Contact    string   `json:"contact"`
+	Phone      string   `json:"phone"`
+	Email      string   `json:"email,omitempty"`
+	Website    string   `json:"website,omitempty"`
+	Address    string   `json:"address"`
+	Mode       []string `json:"mode"`
+	TimeZone   string   `json:"time_zone,omitempty"`
+	ExternalID string   `json:"external_id,omitempty"`
+}
+
+func newSchoolDocument(school *data.School) schoolDocument {
+	return schoolDocument{
+		Name:       school.Name,
+		Level:      school.Level,
+		Contact:    school.Contact,
+		Phone:      school.Phone,
+		Email:      school.Email,
+		Website:    school.Website,
+		Address:    school.Address,
+		Mode:       school.Mode,
+		TimeZone:   school.TimeZone,
+		ExternalID: school.ExternalID,
+	}
+}
+
+// The apply() method replaces every field of school with the document's
+func (doc schoolDocument) apply(school *data.School) {
+	school.Name = doc.Name
+	school.Level = doc.Level
+	school.Contact = doc.Contact
+	school.Phone = doc.Phone
+	school.Email = doc.Email
+	school.Website = doc.Website
+	school.Address = doc.Address
+	school.Mode = doc.Mode
+	school.TimeZone = doc.TimeZone
+	school.ExternalID = doc.ExternalID
+}
+
+// duplicateExternalIDErrors is the validation error for an external ID that belongs to another school
+var duplicateExternalIDErrors = map[string]string{"external_id": "a school with this external ID already exists"}
+
+// The patchSchool() method applies the JSON Merge Patch or JSON Patch in the
+// request body to the school. A field the patch removes or sets to null is
+// left empty, for ValidateSchool() to accept or reject
+func (app *application) patchSchool(w http.ResponseWriter, r *http.Request, school *data.School, contentType string) error {
+	var patch json.RawMessage
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(newSchoolDocument(school))
+	if err != nil {
+		return err
+	}
+	if contentType == jsonpatch.MergePatchType {
+		doc, err = jsonpatch.MergePatch(doc, patch)
+	} else {
+		doc, err = jsonpatch.Apply(doc, patch)
+	}
+	if err != nil {
+		return err
+	}
+
+	var patched schoolDocument
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return fmt.Errorf("patched school is not a valid school: %v", err)
+	}
+	patched.apply(school)
+	return nil
+}
+
+func (app *application) updateSchoolHandler(w http.ResponseWriter, r *http.Request) {
+	//This method does a partial  replacement
+	//Get the id of the school that needs updating
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//Fetch the original record from the database ie school
+	school, err := app.models.Schools.Get(r.Context(), id)
+	//Handle errors
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//the content type decides how the body changes the school. A plain JSON
+	//body treats null as not provided, the patch formats can clear a field
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "", "application/json":
+		//read data from client request and store it in &input struct as go values
+		var input schoolInput
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		input.apply(school)
+	case jsonpatch.MergePatchType, jsonpatch.JSONPatchType:
+		err = app.patchSchool(w, r, school, contentType)
+		if err != nil {
+			switch {
+			case errors.Is(err, jsonpatch.ErrTestFailed):
+				app.errorResponse(w, r, http.StatusConflict, err.Error())
+			case errors.Is(err, jsonpatch.ErrPathNotFound):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
+	default:
+		w.Header().Set("Accept-Patch", schoolPatchTypes)
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
 
 	//Perform validation on the updated school.If validation fails we send
 	//a 422- unprocessable entity response to the client
@@ -172,11 +355,18 @@ func (app *application) updateSchoolHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	//Pass the updated school record to update() method
-	err = app.models.Schools.Update(school)
+	err = app.transaction(r.Context(), func(tx data.Models) error {
+		if err := tx.Schools.Update(r.Context(), school); err != nil {
+			return err
+		}
+		return app.emitEvent(r.Context(), tx, "school.updated", envelope{"school": school})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateExternalID):
+			app.failedValidationResponse(w, r, duplicateExternalIDErrors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -184,11 +374,120 @@ func (app *application) updateSchoolHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	//write to the client the response JSON
-	err = app.writeJSON(w, http.StatusOK, envelope{"school": school}, nil)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"school": school}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// replaceSchoolHandler for the PUT "/v1/schools/:id" endpoint. The body is
+// the whole school, so a field that is left out is cleared rather than kept
+func (app *application) replaceSchoolHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	school, err := app.models.Schools.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input schoolDocument
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	input.apply(school)
+
+	v := validator.New()
+	if data.ValidateSchool(v, school); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.transaction(r.Context(), func(tx data.Models) error {
+		if err := tx.Schools.Update(r.Context(), school); err != nil {
+			return err
+		}
+		return app.emitEvent(r.Context(), tx, "school.updated", envelope{"school": school})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateExternalID):
+			app.failedValidationResponse(w, r, duplicateExternalIDErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"school": school}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// upsertSchoolHandler for the PUT "/v1/schools/by-external-id/:code" endpoint.
+// It creates the school with that external ID, or replaces the one that has
+// it. Sending the same school again changes nothing, not even its version,
+// so a sync can re-send every school without checking which ones exist.
+// Responds 201 when the school was created and 200 otherwise
+func (app *application) upsertSchoolHandler(w http.ResponseWriter, r *http.Request) {
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+	var input schoolDocument
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.ExternalID == "" || input.ExternalID == code, "external_id", "must match the external ID in the URL")
+	school := &data.School{}
+	input.apply(school)
+	school.ExternalID = code
+	if data.ValidateSchool(v, school); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var created bool
+	err = app.transaction(r.Context(), func(tx data.Models) error {
+		var changed bool
+		var err error
+		created, changed, err = tx.Schools.Upsert(r.Context(), school)
+		switch {
+		case err != nil:
+			return err
+		case created:
+			return app.emitEvent(r.Context(), tx, "school.created", envelope{"school": school})
+		case changed:
+			return app.emitEvent(r.Context(), tx, "school.updated", envelope{"school": school})
+		}
+		return nil
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	status := http.StatusOK
+	headers := make(http.Header)
+	if created {
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("/v1/schools/%d", school.ID))
+	}
+	err = app.writeJSON(w, r, status, envelope{"school": school}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) deleteSchoolHandler(w http.ResponseWriter, r *http.Request) {
@@ -198,9 +497,20 @@ func (app *application) deleteSchoolHandler(w http.ResponseWriter, r *http.Reque
 		app.notFoundResponse(w, r)
 		return
 	}
+	//Look up the school's attachments first as their rows are removed along with the school
+	attachments, err := app.models.Attachments.GetAllForSchool(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	//Delete school fro the database.Send 404 status code not found
 	//to the client if there is no matching record
-	err = app.models.Schools.Delete(id)
+	err = app.transaction(r.Context(), func(tx data.Models) error {
+		if err := tx.Schools.Delete(r.Context(), id); err != nil {
+			return err
+		}
+		return app.emitEvent(r.Context(), tx, "school.deleted", envelope{"school": envelope{"id": id}})
+	})
 	//Handle errors
 	if err != nil {
 		switch {
@@ -211,9 +521,13 @@ func (app *application) deleteSchoolHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
+	//purge the attachment files now that the school is gone
+	for _, attachment := range attachments {
+		app.deleteBlobs(r, attachment.BlobKeys()...)
+	}
 	//notify the client deletion was successful
 	//return 200 ok status with success messsage
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "school successfully deleted"}, nil)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "school successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -225,9 +539,8 @@ func (app *application) deleteSchoolHandler(w http.ResponseWriter, r *http.Reque
 func (app *application) listSchoolsHandler(w http.ResponseWriter, r *http.Request) {
 	//create an input struct to hold our query parameters
 	var input struct {
-		Name  string
-		Level string
-		Mode  []string
+		data.SchoolSearch
+		Include []string
 		data.Filters
 	}
 	//initialize a new validator v instance
@@ -238,6 +551,20 @@ func (app *application) listSchoolsHandler(w http.ResponseWriter, r *http.Reques
 	input.Name = app.readString(qs, "name", "")
 	input.Level = app.readString(qs, "level", "")
 	input.Mode = app.readCSV(qs, "mode", []string{})
+	//program filters, ages are in years
+	if qs.Has("age") {
+		age := app.readInt(qs, "age", 0, v)
+		v.Check(validator.Between(age, 0, 99), "age", "must be between 0 and 99")
+		input.Age = &age
+	}
+	input.HasCapacity = app.readBool(qs, "has_capacity", false, v)
+	if value := qs.Get("open_at"); value != "" {
+		openAt, local, ok := parseOpenAt(value)
+		v.Check(ok, "open_at", "must be a date and time such as 2026-10-20T09:00, or now")
+		input.OpenAt, input.OpenAtLocal = &openAt, local
+	}
+	input.Include = app.readCSV(qs, "include", []string{})
+	validateIncludes(v, input.Include)
 	//Get the page info
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
@@ -252,13 +579,26 @@ func (app *application) listSchoolsHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	//Get a listing of all schools
-	schools, metadata, err := app.models.Schools.GetAll(input.Name, input.Level, input.Mode, input.Filters)
+	schools, metadata, err := app.models.Schools.GetAll(r.Context(), input.SchoolSearch, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	for _, school := range schools {
+		if school.LogoAttachmentID != 0 {
+			school.LogoThumbnailURL = thumbnailURL(school.ID, school.LogoAttachmentID)
+		}
+	}
+	var response any = schools
+	if slices.Contains(input.Include, "campuses") {
+		response, err = app.embedCampuses(r, schools...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
 	//send a JSON response containing all the schools
-	err = app.writeJSON(w, http.StatusOK, envelope{"schools": schools, "metadata": metadata}, nil)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"schools": response, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+)
+
+// The serve() method runs the HTTP server until the process receives SIGINT or
+// SIGTERM. It then stops accepting connections, waits for in-flight requests
+// and background jobs to finish, and flushes any buffered spans
+func (app *application) serve(srv *http.Server) error {
+	shutdownError := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+		app.logger.Info("shutting down server", jsonlog.String("signal", s.String()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+		var errs []error
+		errs = append(errs, srv.Shutdown(ctx))
+		//handlers may have queued jobs right up to the end, so drain the jobs second
+		app.logger.Info("draining background jobs", jsonlog.Int("running", app.jobs.Running()))
+		errs = append(errs, app.jobs.Shutdown(ctx))
+		errs = append(errs, app.tracer.Shutdown(ctx))
+		shutdownError <- errors.Join(errs...)
+	}()
+
+	var err error
+	if srv.TLSConfig != nil {
+		//the certificate comes from TLSConfig.GetCertificate so no files are passed here
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err := <-shutdownError; err != nil {
+		return err
+	}
+	app.logger.Info("stopped server", jsonlog.String("addr", srv.Addr))
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+)
+
+// runtimeSettings holds the settings that can change while the server is
+// running. The middleware loads them on every request, and a reload swaps
+// in a new value atomically
+type runtimeSettings struct {
+	logLevel jsonlog.Level
+	limiter  struct {
+		enabled bool
+		rps     float64
+		burst   int
+	}
+	cors struct {
+		trustedOrigins []string
+		maxAge         time.Duration
+	}
+	maintenance bool
+}
+
+// reloadableSettings are the config settings that SIGHUP can change. Changes
+// to anything else only take effect after a restart
+var reloadableSettings = map[string]bool{
+	"log-level":            true,
+	"limiter-enabled":      true,
+	"limiter-rps":          true,
+	"limiter-burst":        true,
+	"cors-trusted-origins": true,
+	"cors-max-age":         true,
+	"maintenance":          true,
+}
+
+// The newRuntimeSettings() function extracts the reloadable settings from cfg.
+// cfg must already have been validated
+func newRuntimeSettings(cfg config) *runtimeSettings {
+	level, _ := jsonlog.ParseLevel(cfg.log.level)
+	settings := &runtimeSettings{
+		logLevel:    level,
+		maintenance: cfg.maintenance,
+	}
+	settings.limiter.enabled = cfg.limiter.enabled
+	settings.limiter.rps = cfg.limiter.rps
+	settings.limiter.burst = cfg.limiter.burst
+	settings.cors.trustedOrigins = cfg.cors.trustedOrigins
+	settings.cors.maxAge = cfg.cors.maxAge
+	return settings
+}
+
+// The handleReloads() method re-reads the configuration every time the process receives SIGHUP
+func (app *application) handleReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		app.reload()
+	}
+}
+
+// The reload() method loads and validates the configuration, then swaps in the
+// new runtime settings. If the configuration is invalid the current settings are kept
+func (app *application) reload() {
+	cfg, _, shadowed, err := loadConfig(os.Args[1:])
+	if err != nil {
+		app.logger.Error(err, jsonlog.String("action", "reload"))
+		app.logger.Warn("configuration reload failed, keeping the current settings")
+		return
+	}
+
+	//warn about reloadable settings that editing the file can't change
+	for _, s := range shadowed {
+		if reloadableSettings[s.name] {
+			app.logger.Warn("config file setting is overridden and was not reloaded",
+				jsonlog.String("setting", s.name),
+				jsonlog.String("overridden_by", s.source),
+			)
+		}
+	}
+
+	//warn about changes that need a restart
+	current, next := effectiveFlags(app.config), effectiveFlags(cfg)
+	next.VisitAll(func(f *flag.Flag) {
+		if reloadableSettings[f.Name] || actionFlags[f.Name] {
+			return
+		}
+		if current.Lookup(f.Name).Value.String() != f.Value.String() {
+			app.logger.Warn("setting cannot be changed without a restart", jsonlog.String("setting", f.Name))
+		}
+	})
+
+	settings := newRuntimeSettings(cfg)
+	previous := app.settings.Swap(settings)
+	app.logger.SetLevel(settings.logLevel)
+	if previous.limiter != settings.limiter {
+		app.limiter.reset()
+	}
+	app.logger.Info("configuration reloaded",
+		jsonlog.String("log_level", settings.logLevel.String()),
+		jsonlog.Bool("limiter_enabled", settings.limiter.enabled),
+		jsonlog.Float64("limiter_rps", settings.limiter.rps),
+		jsonlog.Int("limiter_burst", settings.limiter.burst),
+		jsonlog.Any("cors_trusted_origins", settings.cors.trustedOrigins),
+		jsonlog.Bool("maintenance", settings.maintenance),
+	)
+}
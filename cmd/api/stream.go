@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+)
+
+const (
+	//streamHeartbeat is how often a comment is sent to keep idle proxies from closing the stream
+	streamHeartbeat = 15 * time.Second
+	//streamWriteTimeout replaces the server's write timeout for each event written
+	streamWriteTimeout = 10 * time.Second
+)
+
+// streamSchoolsHandler for the GET "/v1/schools/stream" endpoint. It pushes
+// every school change as a Server-Sent Event whose id is the change sequence
+// number. A client that sends Last-Event-ID, or the since query parameter,
+// first receives the changes it missed. Without either, only new changes are sent
+func (app *application) streamSchoolsHandler(w http.ResponseWriter, r *http.Request) {
+	after := int64(-1)
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("since")
+	}
+	if lastEventID != "" {
+		seq, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || seq < 0 {
+			app.badRequestResponse(w, r, errors.New("Last-Event-ID must be a change sequence number"))
+			return
+		}
+		after = seq
+	}
+
+	//subscribe before reading the backlog so nothing falls in between, the
+	//sequence numbers let us skip anything we see twice
+	changes, unsubscribe := app.changes.subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := app.writeStreamText(w, rc, "retry: 5000\n\n"); err != nil {
+		return
+	}
+
+	if after >= 0 {
+		for {
+			backlog, err := app.models.Changes.GetAfter(r.Context(), after, 100)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+			for _, change := range backlog {
+				if err := app.writeChangeEvent(w, rc, change); err != nil {
+					return
+				}
+				after = change.Seq
+			}
+			if len(backlog) < 100 {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				//dropped by the broker or shutting down, the client will reconnect
+				return
+			}
+			if change.Seq <= after {
+				continue
+			}
+			if err := app.writeChangeEvent(w, rc, change); err != nil {
+				return
+			}
+			after = change.Seq
+		case <-heartbeat.C:
+			if err := app.writeStreamText(w, rc, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// The writeChangeEvent() method writes one change as an event and flushes it to the client
+func (app *application) writeChangeEvent(w http.ResponseWriter, rc *http.ResponseController, change *data.SchoolChange) error {
+	js, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return app.writeStreamText(w, rc, fmt.Sprintf("id: %d\nevent: school.%s\ndata: %s\n\n", change.Seq, change.Operation, js))
+}
+
+// The writeStreamText() method writes raw event stream text, extending the
+// write deadline first so a long-lived stream isn't cut off by the server's WriteTimeout
+func (app *application) writeStreamText(w http.ResponseWriter, rc *http.ResponseController, text string) error {
+	if err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(w, text); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// listSchoolChangesHandler for the GET "/v1/schools/changes" endpoint. It
+// returns the schools created, updated or deleted after the since token, oldest
+// change first, with a token to pass as since on the next call. Without a token
+// every school is returned, so a client can start from scratch
+func (app *application) listSchoolChangesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	since, ok := decodeSyncToken(app.readString(qs, "since", ""))
+	v.Check(ok, "since", "must be a sync token returned by this endpoint")
+	pageSize := app.readInt(qs, "page_size", 100, v)
+	v.Check(pageSize > 0, "page_size", "must be greater than 0")
+	v.Check(pageSize <= 1000, "page_size", "must be a maximum of 1000")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//read one more than asked for to find out if there is another page
+	changes, err := app.models.Changes.GetSince(r.Context(), since, pageSize+1)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	hasMore := len(changes) > pageSize
+	if hasMore {
+		changes = changes[:pageSize]
+	}
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	metadata := envelope{
+		"next_token": encodeSyncToken(next),
+		"has_more":   hasMore,
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"changes": changes, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Sync tokens wrap a change sequence number. They are opaque to clients so the
+// format can change without breaking them
+const syncTokenPrefix = "s1:"
+
+func encodeSyncToken(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(syncTokenPrefix + strconv.FormatInt(seq, 10)))
+}
+
+// decodeSyncToken() returns the sequence number in a token. An empty token means the start
+func decodeSyncToken(token string) (int64, bool) {
+	if token == "" {
+		return 0, true
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, false
+	}
+	value, found := strings.CutPrefix(string(raw), syncTokenPrefix)
+	if !found {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false
+	}
+	return seq, true
+}
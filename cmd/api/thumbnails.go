@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jobs"
+	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/kirwadee/appletree/internal/thumbnail"
+)
+
+// thumbnailJob is the kind of the background job that generates a thumbnail
+const thumbnailJob = "attachment.thumbnail"
+
+type thumbnailPayload struct {
+	SchoolID     int64 `json:"school_id"`
+	AttachmentID int64 `json:"attachment_id"`
+}
+
+// The queueThumbnail() method schedules a thumbnail for an uploaded image. A
+// failure is only logged as the upload itself has succeeded
+func (app *application) queueThumbnail(ctx context.Context, attachment *data.Attachment) {
+	if !thumbnail.Supported(attachment.ContentType) {
+		return
+	}
+	payload := thumbnailPayload{SchoolID: attachment.SchoolID, AttachmentID: attachment.ID}
+	if _, err := app.jobs.Enqueue(ctx, thumbnailJob, payload); err != nil {
+		app.logger.ErrorContext(ctx, err, jsonlog.Int64("attachment_id", attachment.ID))
+	}
+}
+
+// The generateThumbnail() method handles thumbnail jobs. It stores the thumbnail
+// next to the original blob and records its key against the attachment
+func (app *application) generateThumbnail(ctx context.Context, payload thumbnailPayload) error {
+	attachment, err := app.models.Attachments.Get(ctx, payload.SchoolID, payload.AttachmentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			//deleted before we got to it
+			return nil
+		default:
+			return err
+		}
+	}
+	err = app.writeThumbnail(ctx, attachment)
+	switch {
+	case errors.Is(err, thumbnail.ErrUnsupportedFormat), errors.Is(err, thumbnail.ErrImageTooLarge), errors.Is(err, thumbnail.ErrCorruptImage):
+		return jobs.Permanent(err)
+	default:
+		return err
+	}
+}
+
+func (app *application) writeThumbnail(ctx context.Context, attachment *data.Attachment) error {
+	blob, err := app.blobs.Open(ctx, attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var buf bytes.Buffer
+	contentType, err := thumbnail.Make(&buf, blob, app.config.thumbnail.size)
+	if err != nil {
+		return fmt.Errorf("thumbnail: %w", err)
+	}
+	key := attachment.StorageKey + ".thumb"
+	if _, err := app.blobs.Put(ctx, key, &buf); err != nil {
+		return err
+	}
+
+	updated := *attachment
+	updated.ThumbnailKey = key
+	updated.ThumbnailContentType = contentType
+	err = app.models.Attachments.SetThumbnail(ctx, &updated)
+	if err != nil {
+		//nothing refers to the thumbnail, not found means the attachment was deleted while we worked
+		if delErr := app.blobs.Delete(ctx, key); delErr != nil {
+			return delErr
+		}
+		if errors.Is(err, data.ErrorRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
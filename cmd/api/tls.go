@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/jsonlog"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// certReloader serves the certificate, and optionally the client CA pool, most
+// recently loaded from disk so they can be renewed without a restart
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	logger       *jsonlog.Logger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+}
+
+// The newCertReloader() function loads the certificate files and starts a
+// background goroutine that reloads them whenever they change
+func newCertReloader(certFile, keyFile, clientCAFile string, logger *jsonlog.Logger) (*certReloader, error) {
+	cr := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		logger:       logger,
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	go cr.watch()
+	return cr, nil
+}
+
+// load() reads the certificate, key and client CA files from disk
+func (cr *certReloader) load() error {
+	modTimes, err := cr.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if cr.clientCAFile != "" {
+		pem, err := os.ReadFile(cr.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", cr.clientCAFile)
+		}
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.clientCAs = clientCAs
+	cr.modTimes = modTimes
+	return nil
+}
+
+// stat() returns the modification times of the files being watched
+func (cr *certReloader) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, name := range []string{cr.certFile, cr.keyFile, cr.clientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// watch() polls the files and reloads them when any of them has changed.
+// A failed reload keeps serving the previous certificate
+func (cr *certReloader) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		modTimes, err := cr.stat()
+		if err != nil {
+			cr.logger.Error(err, jsonlog.String("component", "tls"))
+			continue
+		}
+		cr.mu.RLock()
+		changed := modTimes != cr.modTimes
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := cr.load(); err != nil {
+			cr.logger.Error(err, jsonlog.String("component", "tls"))
+			cr.logger.Warn("certificate reload failed, keeping the current certificate")
+			continue
+		}
+		cr.logger.Info("TLS certificate reloaded", jsonlog.String("cert_file", cr.certFile))
+	}
+}
+
+// GetCertificate() is used as tls.Config.GetCertificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// The tlsConfig() function builds a server TLS configuration with modern
+// defaults. HTTP/2 is negotiated through ALPN. When a client CA is configured,
+// client certificates signed by it are verified
+func tlsConfig(cr *certReloader, clientAuth string) (*tls.Config, error) {
+	base := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		//TLS 1.3 suites aren't configurable, these only apply to TLS 1.2
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: cr.GetCertificate,
+	}
+	if cr.clientCAFile == "" {
+		return base, nil
+	}
+
+	switch clientAuth {
+	case "verify-if-given":
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("tls-client-auth must be verify-if-given or require")
+	}
+	//hand out a fresh config per handshake so a reloaded client CA pool takes effect
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cr.mu.RLock()
+		cfg.ClientCAs = cr.clientCAs
+		cr.mu.RUnlock()
+		return cfg, nil
+	}
+	return base, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata. These are overridden at link time, for example
+// go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version   = "1.0.0"
+	commit    = ""
+	buildTime = ""
+)
+
+// The buildCommit() function returns the commit injected at link time,
+// falling back to the VCS revision stamped into the binary by the Go toolchain
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	return buildSetting("vcs.revision")
+}
+
+// The buildTimestamp() function returns the build time injected at link time,
+// falling back to the time of the commit stamped into the binary
+func buildTimestamp() string {
+	if buildTime != "" {
+		return buildTime
+	}
+	return buildSetting("vcs.time")
+}
+
+// The buildSetting() function looks up a setting recorded by the Go toolchain
+func buildSetting(key string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == key {
+			return setting.Value
+		}
+	}
+	return "unknown"
+}
+
+// The printVersion() function writes the build metadata for the -version flag
+func printVersion() {
+	fmt.Printf("Version:\t%s\n", version)
+	fmt.Printf("Commit:\t\t%s\n", buildCommit())
+	fmt.Printf("Build time:\t%s\n", buildTimestamp())
+	fmt.Printf("Go version:\t%s\n", runtime.Version())
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jobs"
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// The kinds of the background jobs behind webhooks. An event job records a
+// delivery for every subscribed webhook, and a delivery job sends one of them
+const (
+	webhookEventJob    = "webhook.event"
+	webhookDeliveryJob = "webhook.delivery"
+)
+
+// webhookResponseLimit is how much of a receiver's response body is kept in the delivery log
+const webhookResponseLimit = 1024
+
+// errWebhookAddress is returned when a webhook's host resolves to an address
+// that isn't on the public internet
+var errWebhookAddress = errors.New("webhook address is not a public address")
+
+// webhookClient sends the deliveries. Redirects are not followed so a
+// delivery only ever goes to the URL that was registered. The address is
+// checked again as it is dialled, as a host name that passed validation can
+// later resolve to a loopback, link-local or private address
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		//no proxy, the dialled address is the receiver's
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   webhookDialControl,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	},
+}
+
+// webhookDialControl() refuses connections to addresses that aren't public.
+// It runs after the host name is resolved, once for every address tried
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !validator.PublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errWebhookAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// webhookEvent is the JSON body POSTed to subscribers
+type webhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type webhookDeliveryPayload struct {
+	WebhookID  int64 `json:"webhook_id"`
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+// The emitEvent() method queues an event for the webhooks subscribed to it.
+// models must be bound to the transaction that makes the change behind the
+// event, so the event is queued if and only if the change is saved
+func (app *application) emitEvent(ctx context.Context, models data.Models, eventType string, payload envelope) error {
+	event := webhookEvent{
+		ID:        "evt_" + randomHex(16),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+	}
+	var err error
+	event.Data, err = json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = app.jobs.EnqueueIn(ctx, models.Jobs, webhookEventJob, event)
+	return err
+}
+
+// The transaction() method runs fn in a transaction like Models.Transaction(),
+// then wakes the job dispatcher so events fn queued go out straight away
+func (app *application) transaction(ctx context.Context, fn func(tx data.Models) error) error {
+	err := app.models.Transaction(ctx, fn)
+	if err == nil {
+		app.jobs.Notify()
+	}
+	return err
+}
+
+// The fanOutEvent() method handles event jobs. If the job is retried, webhooks
+// that already have a delivery for the event are skipped unless it was never sent
+func (app *application) fanOutEvent(ctx context.Context, event webhookEvent) error {
+	webhooks, err := app.models.Webhooks.GetAll(ctx, event.Type)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	for _, webhook := range webhooks {
+		delivery := &data.WebhookDelivery{
+			WebhookID: webhook.ID,
+			EventID:   event.ID,
+			Event:     event.Type,
+			Payload:   body,
+		}
+		inserted, err := app.models.Deliveries.Insert(ctx, delivery)
+		if err != nil {
+			return err
+		}
+		if !inserted && (delivery.Status != data.DeliveryPending || delivery.Attempts > 0) {
+			continue
+		}
+		if err := app.queueDelivery(ctx, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *application) queueDelivery(ctx context.Context, delivery *data.WebhookDelivery) error {
+	payload := webhookDeliveryPayload{WebhookID: delivery.WebhookID, DeliveryID: delivery.ID}
+	_, err := app.jobs.Enqueue(ctx, webhookDeliveryJob, payload)
+	return err
+}
+
+// The deliverWebhook() method handles delivery jobs. It POSTs the signed event
+// and records the outcome in the delivery log. Anything but a 2xx response is
+// returned as an error so the job queue retries it with backoff
+func (app *application) deliverWebhook(ctx context.Context, payload webhookDeliveryPayload) error {
+	webhook, err := app.models.Webhooks.Get(ctx, payload.WebhookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+	delivery, err := app.models.Deliveries.Get(ctx, payload.WebhookID, payload.DeliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+	//nothing to do for a webhook that has been switched off or an event that already arrived
+	if !webhook.Active || delivery.Status == data.DeliverySucceeded {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "appletree-webhooks/"+version)
+	req.Header.Set("X-Appletree-Event", delivery.Event)
+	req.Header.Set("X-Appletree-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Appletree-Signature", webhookSignature(webhook.Secret, timestamp, delivery.Payload))
+
+	start := time.Now()
+	resp, err := webhookClient.Do(req)
+	delivery.DurationMS = int(time.Since(start).Milliseconds())
+	if err != nil {
+		delivery.Status = data.DeliveryFailed
+		delivery.ResponseStatus = 0
+		delivery.ResponseBody = ""
+		delivery.Error = err.Error()
+	} else {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+		//drain a little more so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		delivery.ResponseStatus = resp.StatusCode
+		delivery.ResponseBody = string(bytes.ToValidUTF8(body, nil))
+		delivery.Status = data.DeliverySucceeded
+		delivery.Error = ""
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			delivery.Status = data.DeliveryFailed
+			delivery.Error = "unexpected response status " + resp.Status
+		}
+	}
+
+	//record the attempt even if the delivery timed out
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 3*time.Second)
+	defer cancel()
+	if err := app.models.Deliveries.RecordAttempt(recordCtx, delivery); err != nil && !errors.Is(err, data.ErrorRecordNotFound) {
+		return err
+	}
+	if delivery.Status == data.DeliveryFailed {
+		return errors.New(delivery.Error)
+	}
+	return nil
+}
+
+// The webhookSignature() function signs a delivery so the receiver can check it
+// came from us and is recent. The header value is "t=<unix time>,v1=<hex HMAC-SHA256>"
+// where the HMAC, keyed with the webhook's secret, covers "<unix time>.<body>"
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// createWebhookHandler for the POST "/v1/webhooks" endpoint. A secret is
+// generated unless one is given, and it is only ever returned by this endpoint
+// or when it is rotated
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL         string   `json:"url"`
+		Events      []string `json:"events"`
+		Description string   `json:"description"`
+		Secret      *string  `json:"secret"`
+		Active      *bool    `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	webhook := &data.Webhook{
+		URL:         input.URL,
+		Events:      input.Events,
+		Description: input.Description,
+		Secret:      "whsec_" + randomHex(24),
+		Active:      true,
+	}
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Insert(r.Context(), webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"webhook": webhook, "secret": webhook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhooksHandler for the GET "/v1/webhooks" endpoint
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(r.Context(), "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showWebhookHandler for the GET "/v1/webhooks/:id" endpoint
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWebhookHandler for the PATCH "/v1/webhooks/:id" endpoint. Sending a
+// secret rotates it, and the new secret is echoed back
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		URL         *string  `json:"url"`
+		Events      []string `json:"events"`
+		Description *string  `json:"description"`
+		Secret      *string  `json:"secret"`
+		Active      *bool    `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Description != nil {
+		webhook.Description = *input.Description
+	}
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Update(r.Context(), webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	response := envelope{"webhook": webhook}
+	if input.Secret != nil {
+		response["secret"] = webhook.Secret
+	}
+	err = app.writeJSON(w, r, http.StatusOK, response, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteWebhookHandler for the DELETE "/v1/webhooks/:id" endpoint
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Webhooks.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listDeliveriesHandler for the GET "/v1/webhooks/:id/deliveries" endpoint
+func (app *application) listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	var filters data.Filters
+	v := validator.New()
+	qs := r.URL.Query()
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = "id"
+	filters.SortList = []string{"id"}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	deliveries, metadata, err := app.models.Deliveries.GetAllForWebhook(r.Context(), webhook.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showDeliveryHandler for the GET "/v1/webhooks/:id/deliveries/:delivery_id" endpoint
+func (app *application) showDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := app.readDelivery(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// replayDeliveryHandler for the POST "/v1/webhooks/:id/deliveries/:delivery_id/replay"
+// endpoint. It sends the same event again as a new delivery, so the log keeps both
+func (app *application) replayDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	original, ok := app.readDelivery(w, r)
+	if !ok {
+		return
+	}
+	delivery := &data.WebhookDelivery{
+		WebhookID: original.WebhookID,
+		EventID:   original.EventID,
+		Event:     original.Event,
+		Payload:   original.Payload,
+		ReplayOf:  &original.ID,
+	}
+	_, err := app.models.Deliveries.Insert(r.Context(), delivery)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.queueDelivery(r.Context(), delivery)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d/deliveries/%d", delivery.WebhookID, delivery.ID))
+	err = app.writeJSON(w, r, http.StatusAccepted, envelope{"delivery": delivery}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readWebhook() method looks up the webhook named by the route, sending a
+// 404 or 500 response and returning false if it can't
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	webhook, err := app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return webhook, true
+}
+
+// The readDelivery() method looks up the delivery named by the route, sending a
+// 404 or 500 response and returning false if it can't
+func (app *application) readDelivery(w http.ResponseWriter, r *http.Request) (*data.WebhookDelivery, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	deliveryID, err := app.readInt64Param(r, "delivery_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	delivery, err := app.models.Deliveries.Get(r.Context(), id, deliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return delivery, true
+}
@@ -1,7 +1,11 @@
 module github.com/kirwadee/appletree
 
-go 1.20
+go 1.21
 
 require github.com/julienschmidt/httprouter v1.3.0
 
 require github.com/lib/pq v1.10.9
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require golang.org/x/time v0.5.0
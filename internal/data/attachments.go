@@ -0,0 +1,241 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// AttachmentKinds lists the kinds of file a school can attach, with the content types allowed for each
+var AttachmentKinds = map[string][]string{
+	"logo":     {"image/png", "image/jpeg", "image/gif", "image/webp"},
+	"photo":    {"image/png", "image/jpeg", "image/gif", "image/webp"},
+	"document": {"application/pdf"},
+}
+
+// Attachment holds the metadata of a file attached to a school. The contents live in a BlobStore
+type Attachment struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	SchoolID    int64     `json:"school_id"`
+	Kind        string    `json:"kind"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	StorageKey  string    `json:"-"`
+	//set once a thumbnail has been generated for an image
+	ThumbnailKey         string `json:"-"`
+	ThumbnailContentType string `json:"-"`
+}
+
+// BlobKeys() returns the keys of every blob stored for the attachment
+func (a *Attachment) BlobKeys() []string {
+	keys := []string{a.StorageKey}
+	if a.ThumbnailKey != "" {
+		keys = append(keys, a.ThumbnailKey)
+	}
+	return keys
+}
+
+func ValidateAttachment(v *validator.Validator, attachment *Attachment) {
+	allowed, validKind := AttachmentKinds[attachment.Kind]
+	v.Check(attachment.Kind != "", "kind", "must be provided")
+	v.Check(attachment.Kind == "" || validKind, "kind", "must be logo, photo or document")
+
+	v.Check(attachment.Filename != "", "filename", "must be provided")
+	v.Check(len(attachment.Filename) <= 255, "filename", "must not be more than 255 bytes long")
+
+	v.Check(attachment.Size > 0, "file", "must not be empty")
+	if validKind {
+		v.Check(validator.In(attachment.ContentType, allowed...), "file", "content type "+attachment.ContentType+" is not allowed for "+attachment.Kind)
+	}
+}
+
+// Define an AttachmentModel which wraps a sql.DB connection pool
+type AttachmentModel struct {
+	DB querier
+}
+
+// Insert() records the metadata of a newly stored attachment
+func (m AttachmentModel) Insert(ctx context.Context, attachment *Attachment) (err error) {
+	ctx, span := startSpan(ctx, "AttachmentModel.Insert", "insert_attachment")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO attachments(school_id, kind, filename, content_type, size, storage_key)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{
+		attachment.SchoolID, attachment.Kind,
+		attachment.Filename, attachment.ContentType,
+		attachment.Size, attachment.StorageKey,
+	}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&attachment.ID, &attachment.CreatedAt)
+}
+
+// Get() retrieves a specific attachment belonging to a school
+func (m AttachmentModel) Get(ctx context.Context, schoolID, id int64) (_ *Attachment, err error) {
+	ctx, span := startSpan(ctx, "AttachmentModel.Get", "select_attachment")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	SELECT id, created_at, school_id, kind, filename, content_type, size, storage_key,
+	       thumbnail_key, thumbnail_content_type
+	FROM attachments
+	WHERE id = $1 AND school_id = $2
+	`
+	var attachment Attachment
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(ctx, query, id, schoolID).Scan(
+		&attachment.ID,
+		&attachment.CreatedAt,
+		&attachment.SchoolID,
+		&attachment.Kind,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.StorageKey,
+		&attachment.ThumbnailKey,
+		&attachment.ThumbnailContentType,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &attachment, nil
+}
+
+// GetAllForSchool() returns every attachment of a school, oldest first
+func (m AttachmentModel) GetAllForSchool(ctx context.Context, schoolID int64) (_ []*Attachment, err error) {
+	ctx, span := startSpan(ctx, "AttachmentModel.GetAllForSchool", "select_school_attachments")
+	attachments := []*Attachment{}
+	defer func() { finishSpan(span, len(attachments), err) }()
+
+	query := `
+	SELECT id, created_at, school_id, kind, filename, content_type, size, storage_key,
+	       thumbnail_key, thumbnail_content_type
+	FROM attachments
+	WHERE school_id = $1
+	ORDER BY id ASC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, schoolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attachment Attachment
+		err := rows.Scan(
+			&attachment.ID,
+			&attachment.CreatedAt,
+			&attachment.SchoolID,
+			&attachment.Kind,
+			&attachment.Filename,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.StorageKey,
+			&attachment.ThumbnailKey,
+			&attachment.ThumbnailContentType,
+		)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, &attachment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// SetThumbnail() records the blob holding an attachment's thumbnail. It returns
+// ErrorRecordNotFound if the attachment was deleted in the meantime
+func (m AttachmentModel) SetThumbnail(ctx context.Context, attachment *Attachment) (err error) {
+	ctx, span := startSpan(ctx, "AttachmentModel.SetThumbnail", "update_attachment_thumbnail")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE attachments
+	SET thumbnail_key = $1, thumbnail_content_type = $2
+	WHERE id = $3
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, attachment.ThumbnailKey, attachment.ThumbnailContentType, attachment.ID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
+
+// Delete() removes an attachment's metadata and returns the keys of its blobs so they can be removed
+func (m AttachmentModel) Delete(ctx context.Context, schoolID, id int64) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "AttachmentModel.Delete", "delete_attachment")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	DELETE FROM attachments
+	WHERE id = $1 AND school_id = $2
+	RETURNING storage_key, thumbnail_key
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var attachment Attachment
+	err = m.DB.QueryRowContext(ctx, query, id, schoolID).Scan(&attachment.StorageKey, &attachment.ThumbnailKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return attachment.BlobKeys(), nil
+}
+
+// MoveAll() hands every attachment of one school over to another and returns how many were moved
+func (m AttachmentModel) MoveAll(ctx context.Context, fromSchoolID, toSchoolID int64) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "AttachmentModel.MoveAll", "update_attachments_school")
+	var rowsAffected int64
+	defer func() { finishSpan(span, int(rowsAffected), err) }()
+
+	query := `
+	UPDATE attachments
+	SET school_id = $2
+	WHERE school_id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, fromSchoolID, toSchoolID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err = result.RowsAffected()
+	return rowsAffected, err
+}
@@ -0,0 +1,269 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrOverlappingClosure is returned when a closure overlaps another closure of the same school
+var ErrOverlappingClosure = errors.New("overlapping closure")
+
+// Weekdays are the day names opening hours use, indexed like extract(dow) so Sunday is 0
+var Weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// ClockRx matches a time of day as HH:MM. 24:00 is allowed as a closing time
+// so the last interval of a day can run to midnight
+var ClockRx = regexp.MustCompile(`^(([01][0-9]|2[0-3]):[0-5][0-9]|24:00)$`)
+
+// OpeningHours is one interval a school is open on a day of the week, in the
+// school's time zone. Times are HH:MM, which compare correctly as strings
+type OpeningHours struct {
+	Day      string `json:"day"`
+	OpensAt  string `json:"opens_at"`
+	ClosesAt string `json:"closes_at"`
+}
+
+// Closure is a run of days, such as a holiday, when a school is closed
+// whatever its opening hours say. Dates are YYYY-MM-DD and both are included
+type Closure struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	SchoolID  int64     `json:"school_id"`
+	StartsOn  string    `json:"starts_on"`
+	EndsOn    string    `json:"ends_on"`
+	Reason    string    `json:"reason"`
+}
+
+// ValidateOpeningHours() checks a school's week of opening hours as a whole,
+// so that no two intervals on the same day overlap. Intervals may touch
+func ValidateOpeningHours(v *validator.Validator, hours []OpeningHours) {
+	v.Check(len(hours) <= 7*24, "hours", "must not contain more than 168 entries")
+	for i, h := range hours {
+		key := fmt.Sprintf("hours[%d]", i)
+		v.Check(validator.In(h.Day, Weekdays...), key+".day", "must be a day of the week, such as monday")
+		v.Check(validator.Matches(h.OpensAt, ClockRx) && h.OpensAt != "24:00", key+".opens_at", "must be a time in HH:MM format")
+		v.Check(validator.Matches(h.ClosesAt, ClockRx), key+".closes_at", "must be a time in HH:MM format")
+		v.Check(h.ClosesAt > h.OpensAt, key+".closes_at", "must be after opens_at")
+	}
+	if !v.Valid() {
+		return
+	}
+
+	//order the intervals by day and opening time, then each only needs comparing with the one before
+	sorted := make([]int, len(hours))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	slices.SortFunc(sorted, func(a, b int) int {
+		if c := cmp.Compare(slices.Index(Weekdays, hours[a].Day), slices.Index(Weekdays, hours[b].Day)); c != 0 {
+			return c
+		}
+		return cmp.Compare(hours[a].OpensAt, hours[b].OpensAt)
+	})
+	for n := 1; n < len(sorted); n++ {
+		prev, cur := hours[sorted[n-1]], hours[sorted[n]]
+		if cur.Day == prev.Day && cur.OpensAt < prev.ClosesAt {
+			v.AddError(fmt.Sprintf("hours[%d]", sorted[n]), fmt.Sprintf("overlaps hours[%d]", sorted[n-1]))
+		}
+	}
+}
+
+func ValidateClosure(v *validator.Validator, closure *Closure) {
+	v.Check(validator.ValidDate(closure.StartsOn), "starts_on", "must be a date in YYYY-MM-DD format")
+	v.Check(validator.ValidDate(closure.EndsOn), "ends_on", "must be a date in YYYY-MM-DD format")
+	v.Check(validator.NotBefore(closure.StartsOn, closure.EndsOn), "ends_on", "must not be before starts_on")
+
+	v.Check(closure.Reason != "", "reason", "must be provided")
+	v.Check(len(closure.Reason) <= 200, "reason", "must not be more than 200 bytes long")
+}
+
+// Define a CalendarModel which wraps a sql.DB connection pool or a transaction
+type CalendarModel struct {
+	DB querier
+}
+
+// GetOpeningHours() returns a school's opening hours from Sunday to Saturday
+func (m CalendarModel) GetOpeningHours(ctx context.Context, schoolID int64) (_ []OpeningHours, err error) {
+	ctx, span := startSpan(ctx, "CalendarModel.GetOpeningHours", "select_opening_hours")
+	hours := []OpeningHours{}
+	defer func() { finishSpan(span, len(hours), err) }()
+
+	query := `
+	SELECT weekday, to_char(opens_at, 'HH24:MI'), to_char(closes_at, 'HH24:MI')
+	FROM opening_hours
+	WHERE school_id = $1
+	ORDER BY weekday ASC, opens_at ASC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, schoolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h OpeningHours
+		var weekday int
+		if err := rows.Scan(&weekday, &h.OpensAt, &h.ClosesAt); err != nil {
+			return nil, err
+		}
+		h.Day = Weekdays[weekday]
+		hours = append(hours, h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return hours, nil
+}
+
+// ReplaceOpeningHours() swaps all of a school's opening hours for the given
+// ones. The school row is locked first so that two replacements of the same
+// school can't interleave, and it must run in a transaction for that to hold
+func (m CalendarModel) ReplaceOpeningHours(ctx context.Context, schoolID int64, hours []OpeningHours) (err error) {
+	ctx, span := startSpan(ctx, "CalendarModel.ReplaceOpeningHours", "replace_opening_hours")
+	defer func() { finishSpan(span, len(hours), err) }()
+
+	query := `
+	SELECT id
+	FROM schools
+	WHERE id = $1
+	FOR UPDATE
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var id int64
+	err = m.DB.QueryRowContext(ctx, query, schoolID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+	query = `
+	DELETE FROM opening_hours
+	WHERE school_id = $1
+	`
+	_, err = m.DB.ExecContext(ctx, query, schoolID)
+	if err != nil {
+		return err
+	}
+	if len(hours) == 0 {
+		return nil
+	}
+	weekdays := make([]int64, len(hours))
+	opens := make([]string, len(hours))
+	closes := make([]string, len(hours))
+	for i, h := range hours {
+		weekdays[i] = int64(slices.Index(Weekdays, h.Day))
+		opens[i] = h.OpensAt
+		closes[i] = h.ClosesAt
+	}
+	query = `
+	INSERT INTO opening_hours(school_id, weekday, opens_at, closes_at)
+	SELECT $1, weekday, opens_at::time, closes_at::time
+	FROM unnest($2::smallint[], $3::text[], $4::text[]) AS h(weekday, opens_at, closes_at)
+	`
+	_, err = m.DB.ExecContext(ctx, query, schoolID, pq.Array(weekdays), pq.Array(opens), pq.Array(closes))
+	return err
+}
+
+// GetClosures() returns a school's closures in date order
+func (m CalendarModel) GetClosures(ctx context.Context, schoolID int64) (_ []*Closure, err error) {
+	ctx, span := startSpan(ctx, "CalendarModel.GetClosures", "select_school_closures")
+	closures := []*Closure{}
+	defer func() { finishSpan(span, len(closures), err) }()
+
+	query := `
+	SELECT id, created_at, school_id, to_char(starts_on, 'YYYY-MM-DD'), to_char(ends_on, 'YYYY-MM-DD'), reason
+	FROM school_closures
+	WHERE school_id = $1
+	ORDER BY starts_on ASC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, schoolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var closure Closure
+		err := rows.Scan(
+			&closure.ID,
+			&closure.CreatedAt,
+			&closure.SchoolID,
+			&closure.StartsOn,
+			&closure.EndsOn,
+			&closure.Reason,
+		)
+		if err != nil {
+			return nil, err
+		}
+		closures = append(closures, &closure)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return closures, nil
+}
+
+// InsertClosure() adds a closure to a school, returning ErrOverlappingClosure
+// if the school is already closed on any of its days
+func (m CalendarModel) InsertClosure(ctx context.Context, closure *Closure) (err error) {
+	ctx, span := startSpan(ctx, "CalendarModel.InsertClosure", "insert_school_closure")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO school_closures(school_id, starts_on, ends_on, reason)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{closure.SchoolID, closure.StartsOn, closure.EndsOn, closure.Reason}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&closure.ID, &closure.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23P01" && pqErr.Constraint == "school_closures_no_overlap" {
+		return ErrOverlappingClosure
+	}
+	return err
+}
+
+// DeleteClosure() removes a closure from a school
+func (m CalendarModel) DeleteClosure(ctx context.Context, schoolID, id int64) (err error) {
+	ctx, span := startSpan(ctx, "CalendarModel.DeleteClosure", "delete_school_closure")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return ErrorRecordNotFound
+	}
+	query := `
+	DELETE FROM school_closures
+	WHERE id = $1 AND school_id = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, schoolID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
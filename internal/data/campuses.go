@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Campus is one site of a school, with its own address, phone and modes
+type Campus struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	SchoolID  int64     `json:"school_id"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	Phone     string    `json:"phone"`
+	Mode      []string  `json:"mode"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateCampus(v *validator.Validator, campus *Campus) {
+	v.Check(campus.Name != "", "name", "must be provided")
+	v.Check(len(campus.Name) <= 200, "name", "must not be more than 200 bytes long")
+
+	v.Check(campus.Address != "", "address", "must be provided")
+	v.Check(len(campus.Address) <= 500, "address", "must not be more than 500 bytes long")
+
+	v.Check(campus.Phone != "", "phone", "must be provided")
+	v.Check(validator.Matches(campus.Phone, validator.PhoneRx), "phone", "must be a valid phone number")
+
+	v.Check(campus.Mode != nil, "mode", "must be provided")
+	v.Check(len(campus.Mode) >= 1, "mode", "must contain at least 1 entry")
+	v.Check(len(campus.Mode) <= 5, "mode", "must contain at most 5 entries")
+	v.Check(validator.Unique(campus.Mode), "mode", "must not contain duplicate entries")
+}
+
+// Define a CampusModel which wraps a sql.DB connection pool or a transaction
+type CampusModel struct {
+	DB querier
+}
+
+// Insert() adds a campus to a school
+func (m CampusModel) Insert(ctx context.Context, campus *Campus) (err error) {
+	ctx, span := startSpan(ctx, "CampusModel.Insert", "insert_campus")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO campuses(school_id, name, address, phone, mode)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at, version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{campus.SchoolID, campus.Name, campus.Address, campus.Phone, pq.Array(campus.Mode)}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&campus.ID, &campus.CreatedAt, &campus.Version)
+}
+
+// Get() returns a campus, provided it belongs to the given school
+func (m CampusModel) Get(ctx context.Context, schoolID, id int64) (_ *Campus, err error) {
+	ctx, span := startSpan(ctx, "CampusModel.Get", "select_campus")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	SELECT id, created_at, school_id, name, address, phone, mode, version
+	FROM campuses
+	WHERE id = $1 AND school_id = $2
+	`
+	var campus Campus
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(ctx, query, id, schoolID).Scan(
+		&campus.ID,
+		&campus.CreatedAt,
+		&campus.SchoolID,
+		&campus.Name,
+		&campus.Address,
+		&campus.Phone,
+		pq.Array(&campus.Mode),
+		&campus.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &campus, nil
+}
+
+// GetAllForSchool() returns every campus of a school, oldest first
+func (m CampusModel) GetAllForSchool(ctx context.Context, schoolID int64) ([]*Campus, error) {
+	campuses, err := m.GetAllForSchools(ctx, []int64{schoolID})
+	if err != nil {
+		return nil, err
+	}
+	if campuses[schoolID] == nil {
+		return []*Campus{}, nil
+	}
+	return campuses[schoolID], nil
+}
+
+// GetAllForSchools() returns the campuses of several schools in one query,
+// keyed by school id. Schools without campuses have no entry
+func (m CampusModel) GetAllForSchools(ctx context.Context, schoolIDs []int64) (_ map[int64][]*Campus, err error) {
+	ctx, span := startSpan(ctx, "CampusModel.GetAllForSchools", "select_school_campuses")
+	campuses := make(map[int64][]*Campus)
+	count := 0
+	defer func() { finishSpan(span, count, err) }()
+
+	if len(schoolIDs) == 0 {
+		return campuses, nil
+	}
+	query := `
+	SELECT id, created_at, school_id, name, address, phone, mode, version
+	FROM campuses
+	WHERE school_id = ANY($1)
+	ORDER BY school_id ASC, id ASC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(schoolIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var campus Campus
+		err := rows.Scan(
+			&campus.ID,
+			&campus.CreatedAt,
+			&campus.SchoolID,
+			&campus.Name,
+			&campus.Address,
+			&campus.Phone,
+			pq.Array(&campus.Mode),
+			&campus.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		campuses[campus.SchoolID] = append(campuses[campus.SchoolID], &campus)
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return campuses, nil
+}
+
+// Update() saves changes to a campus, with optimistic locking on its version number
+func (m CampusModel) Update(ctx context.Context, campus *Campus) (err error) {
+	ctx, span := startSpan(ctx, "CampusModel.Update", "update_campus")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE campuses
+	SET name = $1, address = $2, phone = $3, mode = $4, version = version + 1
+	WHERE id = $5 AND school_id = $6 AND version = $7
+	RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{
+		campus.Name,
+		campus.Address,
+		campus.Phone,
+		pq.Array(campus.Mode),
+		campus.ID,
+		campus.SchoolID,
+		campus.Version,
+	}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&campus.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a campus from a school
+func (m CampusModel) Delete(ctx context.Context, schoolID, id int64) (err error) {
+	ctx, span := startSpan(ctx, "CampusModel.Delete", "delete_campus")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return ErrorRecordNotFound
+	}
+	query := `
+	DELETE FROM campuses
+	WHERE id = $1 AND school_id = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, schoolID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
+
+// MoveAll() hands every campus of one school over to another and returns how many were moved
+func (m CampusModel) MoveAll(ctx context.Context, fromSchoolID, toSchoolID int64) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "CampusModel.MoveAll", "update_campuses_school")
+	var rowsAffected int64
+	defer func() { finishSpan(span, int(rowsAffected), err) }()
+
+	query := `
+	UPDATE campuses
+	SET school_id = $2
+	WHERE school_id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, fromSchoolID, toSchoolID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err = result.RowsAffected()
+	return rowsAffected, err
+}
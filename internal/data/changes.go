@@ -0,0 +1,252 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The operations recorded in the school_changes table
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// SchoolChange is one entry of the change sequence written by the schools
+// trigger. School holds the school as the change left it, and is nil for a
+// deletion. From GetSince() it holds the school as it is now
+type SchoolChange struct {
+	Seq       int64     `json:"seq"`
+	CreatedAt time.Time `json:"created_at"`
+	SchoolID  int64     `json:"school_id"`
+	Operation string    `json:"operation"`
+	Version   int32     `json:"version"`
+	School    *School   `json:"school,omitempty"`
+}
+
+// Define a ChangeModel which wraps a sql.DB connection pool
+type ChangeModel struct {
+	DB *sql.DB
+}
+
+// GetAfter() returns up to limit changes with a sequence number above after,
+// oldest first. Each change carries the snapshot of the school the trigger
+// took, so its School always matches its Version. Changes recorded before
+// snapshots were kept have none, apart from the latest change of each school
+func (m ChangeModel) GetAfter(ctx context.Context, after int64, limit int) (_ []*SchoolChange, err error) {
+	ctx, span := startSpan(ctx, "ChangeModel.GetAfter", "select_school_changes")
+	changes := []*SchoolChange{}
+	defer func() { finishSpan(span, len(changes), err) }()
+
+	query := `
+	SELECT seq, created_at, school_id, operation, version, school
+	FROM school_changes
+	WHERE seq > $1
+	ORDER BY seq ASC
+	LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change SchoolChange
+		var snapshot []byte
+		err := rows.Scan(
+			&change.Seq,
+			&change.CreatedAt,
+			&change.SchoolID,
+			&change.Operation,
+			&change.Version,
+			&snapshot,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot != nil {
+			var row schoolSnapshot
+			if err := json.Unmarshal(snapshot, &row); err != nil {
+				return nil, err
+			}
+			change.School = row.school()
+		}
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// GetSince() returns up to limit schools changed after the since sequence
+// number, in sequence order. Each school appears once with its latest state,
+// and each school deleted since then appears as a tombstone with a nil School
+func (m ChangeModel) GetSince(ctx context.Context, since int64, limit int) (_ []*SchoolChange, err error) {
+	ctx, span := startSpan(ctx, "ChangeModel.GetSince", "select_school_sync_page")
+	changes := []*SchoolChange{}
+	defer func() { finishSpan(span, len(changes), err) }()
+
+	//schools saved before the change feed existed have no change row and count as created
+	query := `
+	SELECT seq, created_at, school_id, operation, version,
+	       s_id, s_created_at, s_name, s_level, s_contact, s_phone, s_email, s_website, s_address, s_mode,
+	       s_time_zone, s_external_id, s_version
+	FROM (
+		SELECT s.change_seq AS seq, COALESCE(c.created_at, s.created_at) AS created_at, s.id AS school_id,
+		       COALESCE(c.operation, 'created') AS operation, s.version,
+		       s.id AS s_id, s.created_at AS s_created_at, s.name AS s_name, s.level AS s_level,
+		       s.contact AS s_contact, s.phone AS s_phone, s.email AS s_email, s.website AS s_website,
+		       s.address AS s_address, s.mode AS s_mode, s.time_zone AS s_time_zone,
+		       s.external_id AS s_external_id, s.version AS s_version
+		FROM schools s
+		LEFT JOIN school_changes c ON c.seq = s.change_seq
+		WHERE s.change_seq > $1
+		UNION ALL
+		SELECT c.seq, c.created_at, c.school_id, c.operation, c.version,
+		       NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL
+		FROM school_changes c
+		WHERE c.operation = 'deleted' AND c.seq > $1
+	) changes
+	ORDER BY seq ASC
+	LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change SchoolChange
+		var school nullableSchool
+		err := rows.Scan(
+			&change.Seq,
+			&change.CreatedAt,
+			&change.SchoolID,
+			&change.Operation,
+			&change.Version,
+			&school.ID,
+			&school.CreatedAt,
+			&school.Name,
+			&school.Level,
+			&school.Contact,
+			&school.Phone,
+			&school.Email,
+			&school.Website,
+			&school.Address,
+			pq.Array(&school.Mode),
+			&school.TimeZone,
+			&school.ExternalID,
+			&school.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		change.School = school.school()
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Latest() returns the newest sequence number, or 0 if nothing has changed yet
+func (m ChangeModel) Latest(ctx context.Context) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "ChangeModel.Latest", "select_latest_school_change")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	SELECT COALESCE(MAX(seq), 0)
+	FROM school_changes
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var seq int64
+	err = m.DB.QueryRowContext(ctx, query).Scan(&seq)
+	return seq, err
+}
+
+// schoolSnapshot decodes the to_jsonb() of a schools row kept in school_changes,
+// whose keys are the column names
+type schoolSnapshot struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Name       string    `json:"name"`
+	Level      string    `json:"level"`
+	Contact    string    `json:"contact"`
+	Phone      string    `json:"phone"`
+	Email      string    `json:"email"`
+	Website    string    `json:"website"`
+	Address    string    `json:"address"`
+	Mode       []string  `json:"mode"`
+	TimeZone   string    `json:"time_zone"`
+	ExternalID string    `json:"external_id"`
+	Version    int32     `json:"version"`
+}
+
+// school() returns the snapshot as a School
+func (s schoolSnapshot) school() *School {
+	return &School{
+		ID:         s.ID,
+		CreatedAt:  s.CreatedAt,
+		Name:       s.Name,
+		Level:      s.Level,
+		Contact:    s.Contact,
+		Phone:      s.Phone,
+		Email:      s.Email,
+		Website:    s.Website,
+		Address:    s.Address,
+		Mode:       s.Mode,
+		TimeZone:   s.TimeZone,
+		ExternalID: s.ExternalID,
+		Version:    s.Version,
+	}
+}
+
+// nullableSchool scans the columns of a school that may be missing from an outer join
+type nullableSchool struct {
+	ID         sql.NullInt64
+	CreatedAt  sql.NullTime
+	Name       sql.NullString
+	Level      sql.NullString
+	Contact    sql.NullString
+	Phone      sql.NullString
+	Email      sql.NullString
+	Website    sql.NullString
+	Address    sql.NullString
+	Mode       []string
+	TimeZone   sql.NullString
+	ExternalID sql.NullString
+	Version    sql.NullInt32
+}
+
+// school() returns the scanned school, or nil if the join found none
+func (s nullableSchool) school() *School {
+	if !s.ID.Valid {
+		return nil
+	}
+	return &School{
+		ID:         s.ID.Int64,
+		CreatedAt:  s.CreatedAt.Time,
+		Name:       s.Name.String,
+		Level:      s.Level.String,
+		Contact:    s.Contact.String,
+		Phone:      s.Phone.String,
+		Email:      s.Email.String,
+		Website:    s.Website.String,
+		Address:    s.Address.String,
+		Mode:       s.Mode,
+		TimeZone:   s.TimeZone.String,
+		ExternalID: s.ExternalID.String,
+		Version:    s.Version.Int32,
+	}
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKey is a client's Idempotency-Key together with a fingerprint of
+// the request it was first sent with and, once that request has finished, the
+// response to replay
+type IdempotencyKey struct {
+	Key         string
+	CreatedAt   time.Time
+	Fingerprint string
+	StatusCode  int //0 while the request is in progress
+	Header      http.Header
+	Body        []byte
+}
+
+// Completed() reports whether the response has been stored
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
+
+// Define an IdempotencyKeyModel which wraps a sql.DB connection pool
+type IdempotencyKeyModel struct {
+	DB *sql.DB
+}
+
+// Acquire() claims key for a request with the given fingerprint. It returns
+// true when the caller now holds the key and should run the request, and
+// otherwise the key as it is stored, to be replayed or rejected. A key older
+// than retention counts as unused, and a key the same request has held for
+// longer than lease without finishing is taken over. ErrEditConflict means the
+// key was released while it was being read
+func (m IdempotencyKeyModel) Acquire(ctx context.Context, key, fingerprint string, retention, lease time.Duration) (_ *IdempotencyKey, acquired bool, err error) {
+	ctx, span := startSpan(ctx, "IdempotencyKeyModel.Acquire", "acquire_idempotency_key")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO idempotency_keys(key, fingerprint)
+	VALUES ($1, $2)
+	ON CONFLICT (key) DO UPDATE
+	SET created_at = NOW(), fingerprint = EXCLUDED.fingerprint, locked_at = NOW(),
+	    status_code = NULL, response_header = NULL, response_body = NULL
+	WHERE idempotency_keys.created_at < NOW() - make_interval(secs => $3)
+	   OR (idempotency_keys.status_code IS NULL
+	       AND idempotency_keys.fingerprint = EXCLUDED.fingerprint
+	       AND idempotency_keys.locked_at < NOW() - make_interval(secs => $4))
+	RETURNING key
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var claimed string
+	err = m.DB.QueryRowContext(ctx, query, key, fingerprint, retention.Seconds(), lease.Seconds()).Scan(&claimed)
+	switch {
+	case err == nil:
+		return nil, true, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, false, err
+	}
+
+	//someone else holds the key, or has already finished with it
+	query = `
+	SELECT key, created_at, fingerprint, COALESCE(status_code, 0), response_header, response_body
+	FROM idempotency_keys
+	WHERE key = $1
+	`
+	var stored IdempotencyKey
+	var header []byte
+	err = m.DB.QueryRowContext(ctx, query, key).Scan(
+		&stored.Key,
+		&stored.CreatedAt,
+		&stored.Fingerprint,
+		&stored.StatusCode,
+		&header,
+		&stored.Body,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, false, ErrEditConflict
+		default:
+			return nil, false, err
+		}
+	}
+	if header != nil {
+		if err = json.Unmarshal(header, &stored.Header); err != nil {
+			return nil, false, err
+		}
+	}
+	return &stored, false, nil
+}
+
+// Complete() stores the response of the request holding key
+func (m IdempotencyKeyModel) Complete(ctx context.Context, key string, statusCode int, header http.Header, body []byte) (err error) {
+	ctx, span := startSpan(ctx, "IdempotencyKeyModel.Complete", "complete_idempotency_key")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	js, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	query := `
+	UPDATE idempotency_keys
+	SET status_code = $2, response_header = $3, response_body = $4
+	WHERE key = $1 AND status_code IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	//jsonb must be sent as text, lib/pq sends []byte as bytea
+	_, err = m.DB.ExecContext(ctx, query, key, statusCode, string(js), body)
+	return err
+}
+
+// Release() gives up an unfinished key so the request can be retried with it
+func (m IdempotencyKeyModel) Release(ctx context.Context, key string) (err error) {
+	ctx, span := startSpan(ctx, "IdempotencyKeyModel.Release", "release_idempotency_key")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE key = $1 AND status_code IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// DeleteExpired() removes the keys created before the given time and returns how many were removed
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "IdempotencyKeyModel.DeleteExpired", "delete_expired_idempotency_keys")
+	var rowsAffected int64
+	defer func() { finishSpan(span, int(rowsAffected), err) }()
+
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE created_at < $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err = result.RowsAffected()
+	return rowsAffected, err
+}
@@ -0,0 +1,333 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The states a job moves through. A failed job goes back to pending until it
+// runs out of attempts and is dead-lettered
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobDead    = "dead"
+)
+
+// JobStatuses lists every job status, for validating filters
+var JobStatuses = []string{JobPending, JobRunning, JobDone, JobDead}
+
+// Job is a unit of background work stored in the jobs table
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LockedAt    *time.Time      `json:"locked_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// JobStats counts the jobs of one kind in each state
+type JobStats struct {
+	Kind          string     `json:"kind"`
+	Pending       int        `json:"pending"`
+	Running       int        `json:"running"`
+	Done          int        `json:"done"`
+	Dead          int        `json:"dead"`
+	OldestPending *time.Time `json:"oldest_pending,omitempty"`
+}
+
+// Define a JobModel which wraps a sql.DB connection pool or a transaction
+type JobModel struct {
+	DB querier
+}
+
+const jobColumns = `id, created_at, kind, payload, status, attempts, max_attempts, run_at, locked_at, finished_at, last_error`
+
+func scanJob(row interface{ Scan(...any) error }, job *Job) error {
+	return row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LockedAt,
+		&job.FinishedAt,
+		&job.LastError,
+	)
+}
+
+// Insert() adds a pending job. A zero RunAt means the job can run straight away
+func (m JobModel) Insert(ctx context.Context, job *Job) (err error) {
+	ctx, span := startSpan(ctx, "JobModel.Insert", "insert_job")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	query := `
+	INSERT INTO jobs(kind, payload, max_attempts, run_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at, status
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	//pass the payload as text, lib/pq would send a []byte as bytea
+	args := []interface{}{job.Kind, string(job.Payload), job.MaxAttempts, job.RunAt}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&job.ID, &job.CreatedAt, &job.Status)
+}
+
+// Claim() locks the next due job of one of the given kinds and marks it running.
+// Running jobs whose lease has expired, because their worker died, are claimed
+// again, unless they have used up their attempts, in which case they are
+// dead-lettered so that a job which kills its worker can't retry forever.
+// SKIP LOCKED lets any number of dispatchers poll the table without blocking
+// each other. It returns ErrorRecordNotFound when there is nothing to do
+func (m JobModel) Claim(ctx context.Context, kinds []string, lease time.Duration) (_ *Job, err error) {
+	ctx, span := startSpan(ctx, "JobModel.Claim", "claim_job")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	WITH buried AS (
+		UPDATE jobs
+		SET status = 'dead', finished_at = NOW(), locked_at = NULL,
+		    last_error = 'lease expired on the last attempt'
+		WHERE kind = ANY($1)
+		AND status = 'running' AND locked_at < NOW() - make_interval(secs => $2)
+		AND attempts >= max_attempts
+	)
+	UPDATE jobs
+	SET status = 'running', attempts = attempts + 1, locked_at = NOW()
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE kind = ANY($1)
+		AND ((status = 'pending' AND run_at <= NOW())
+		  OR (status = 'running' AND locked_at < NOW() - make_interval(secs => $2)
+		      AND attempts < max_attempts))
+		ORDER BY run_at, id
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	)
+	RETURNING ` + jobColumns
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var job Job
+	err = scanJob(m.DB.QueryRowContext(ctx, query, pq.Array(kinds), lease.Seconds()), &job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// Complete() marks a claimed job as done
+func (m JobModel) Complete(ctx context.Context, job *Job) (err error) {
+	ctx, span := startSpan(ctx, "JobModel.Complete", "complete_job")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE jobs
+	SET status = 'done', finished_at = NOW(), locked_at = NULL, last_error = ''
+	WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	return m.release(ctx, query, job.ID, job.Attempts)
+}
+
+// Retry() returns a failed job to the queue to run again at runAt
+func (m JobModel) Retry(ctx context.Context, job *Job, runAt time.Time, reason string) (err error) {
+	ctx, span := startSpan(ctx, "JobModel.Retry", "retry_job")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE jobs
+	SET status = 'pending', run_at = $3, last_error = $4, locked_at = NULL
+	WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	return m.release(ctx, query, job.ID, job.Attempts, runAt, reason)
+}
+
+// Bury() dead-letters a job that has failed for good. Dead jobs are kept until
+// they are requeued by hand
+func (m JobModel) Bury(ctx context.Context, job *Job, reason string) (err error) {
+	ctx, span := startSpan(ctx, "JobModel.Bury", "bury_job")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE jobs
+	SET status = 'dead', finished_at = NOW(), last_error = $3, locked_at = NULL
+	WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	return m.release(ctx, query, job.ID, job.Attempts, reason)
+}
+
+// release() runs one of the statements that end a claim. The attempts column
+// identifies the claim, so a worker whose lease expired and was claimed again
+// can't overwrite the newer result. That case returns ErrorRecordNotFound
+func (m JobModel) release(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
+
+// Requeue() moves a dead job back to pending with a fresh set of attempts
+func (m JobModel) Requeue(ctx context.Context, id int64) (_ *Job, err error) {
+	ctx, span := startSpan(ctx, "JobModel.Requeue", "requeue_job")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	UPDATE jobs
+	SET status = 'pending', attempts = 0, run_at = NOW(), finished_at = NULL
+	WHERE id = $1 AND status = 'dead'
+	RETURNING ` + jobColumns
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var job Job
+	err = scanJob(m.DB.QueryRowContext(ctx, query, id), &job)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// GetAll() lists jobs, newest first, optionally filtered by status and kind
+func (m JobModel) GetAll(ctx context.Context, status, kind string, filters Filters) (_ []*Job, _ Metadata, err error) {
+	ctx, span := startSpan(ctx, "JobModel.GetAll", "select_jobs")
+	jobs := []*Job{}
+	defer func() { finishSpan(span, len(jobs), err) }()
+
+	query := fmt.Sprintf(`
+	SELECT COUNT(*) OVER(), %s
+	FROM jobs
+	WHERE (status = $1 OR $1 = '')
+	AND (kind = $2 OR $2 = '')
+	ORDER BY id DESC
+	LIMIT $3 OFFSET $4`, jobColumns)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, status, kind, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	for rows.Next() {
+		var job Job
+		err := rows.Scan(
+			&totalRecords,
+			&job.ID,
+			&job.CreatedAt,
+			&job.Kind,
+			&job.Payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LockedAt,
+			&job.FinishedAt,
+			&job.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		jobs = append(jobs, &job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return jobs, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Stats() counts the jobs of each kind in each state
+func (m JobModel) Stats(ctx context.Context) (_ []*JobStats, err error) {
+	ctx, span := startSpan(ctx, "JobModel.Stats", "select_job_stats")
+	stats := []*JobStats{}
+	defer func() { finishSpan(span, len(stats), err) }()
+
+	query := `
+	SELECT kind,
+		COUNT(*) FILTER (WHERE status = 'pending'),
+		COUNT(*) FILTER (WHERE status = 'running'),
+		COUNT(*) FILTER (WHERE status = 'done'),
+		COUNT(*) FILTER (WHERE status = 'dead'),
+		MIN(run_at) FILTER (WHERE status = 'pending')
+	FROM jobs
+	GROUP BY kind
+	ORDER BY kind
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s JobStats
+		err := rows.Scan(&s.Kind, &s.Pending, &s.Running, &s.Done, &s.Dead, &s.OldestPending)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// DeleteFinished() removes jobs that completed before the cutoff and returns how many were removed
+func (m JobModel) DeleteFinished(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "JobModel.DeleteFinished", "delete_finished_jobs")
+	var rowsAffected int64
+	defer func() { finishSpan(span, int(rowsAffected), err) }()
+
+	query := `
+	DELETE FROM jobs
+	WHERE status = 'done' AND finished_at < $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err = result.RowsAffected()
+	return rowsAffected, err
+}
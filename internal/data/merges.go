@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The reasons a school revision is recorded
+const (
+	RevisionBeforeMerge = "before_merge" //the surviving school, as it was before the merge
+	RevisionMerged      = "merged"       //the school that was merged away
+)
+
+// MinDuplicateSimilarity is the lowest name similarity FindDuplicates() accepts.
+// It is pg_trgm's default threshold, which lets the trigram index find the pairs
+const MinDuplicateSimilarity = 0.3
+
+// DuplicateCandidate is a pair of schools that may be the same school. Score
+// is the trigram similarity of their names plus 0.2 for each of phone, email
+// and website that they share, listed in Matches
+type DuplicateCandidate struct {
+	Score          float64    `json:"score"`
+	NameSimilarity float64    `json:"name_similarity"`
+	Matches        []string   `json:"matches"`
+	Schools        [2]*School `json:"schools"`
+}
+
+// SchoolRevision is a snapshot of a school taken before a merge changed or removed it
+type SchoolRevision struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	SchoolID  int64     `json:"school_id"`
+	Version   int32     `json:"version"`
+	Reason    string    `json:"reason"`
+	School    *School   `json:"school"`
+}
+
+// FindDuplicates() returns pairs of schools whose names have at least the given
+// trigram similarity, most likely duplicates first
+func (m SchoolModel) FindDuplicates(ctx context.Context, minSimilarity float64, filters Filters) (_ []*DuplicateCandidate, _ Metadata, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.FindDuplicates", "select_school_duplicates")
+	candidates := []*DuplicateCandidate{}
+	defer func() { finishSpan(span, len(candidates), err) }()
+
+	//the % operator uses the trigram index, the threshold can only be raised from there
+	query := `
+	WITH pairs AS (
+		SELECT a.id AS a_id, b.id AS b_id,
+		       similarity(a.name, b.name) AS name_similarity,
+		       a.phone = b.phone AS same_phone,
+		       (a.email <> '' AND lower(a.email) = lower(b.email)) AS same_email,
+		       (a.website <> '' AND lower(a.website) = lower(b.website)) AS same_website
+		FROM schools a
+		JOIN schools b ON a.id < b.id AND a.name % b.name
+	)
+	SELECT COUNT(*) OVER(),
+	       p.name_similarity + 0.2 * (p.same_phone::int + p.same_email::int + p.same_website::int) AS score,
+	       p.name_similarity, p.same_phone, p.same_email, p.same_website,
+	       a.id, a.created_at, a.name, a.level, a.contact, a.phone, a.email, a.website, a.address, a.mode,
+	       a.time_zone, COALESCE(a.external_id, ''), a.version,
+	       b.id, b.created_at, b.name, b.level, b.contact, b.phone, b.email, b.website, b.address, b.mode,
+	       b.time_zone, COALESCE(b.external_id, ''), b.version
+	FROM pairs p
+	JOIN schools a ON a.id = p.a_id
+	JOIN schools b ON b.id = p.b_id
+	WHERE p.name_similarity >= $1
+	ORDER BY score DESC, a.id ASC, b.id ASC
+	LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, minSimilarity, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	for rows.Next() {
+		candidate := DuplicateCandidate{Matches: []string{}}
+		var a, b School
+		var samePhone, sameEmail, sameWebsite bool
+		err := rows.Scan(
+			&totalRecords,
+			&candidate.Score,
+			&candidate.NameSimilarity,
+			&samePhone,
+			&sameEmail,
+			&sameWebsite,
+			&a.ID, &a.CreatedAt, &a.Name, &a.Level, &a.Contact, &a.Phone, &a.Email, &a.Website, &a.Address,
+			pq.Array(&a.Mode), &a.TimeZone, &a.ExternalID, &a.Version,
+			&b.ID, &b.CreatedAt, &b.Name, &b.Level, &b.Contact, &b.Phone, &b.Email, &b.Website, &b.Address,
+			pq.Array(&b.Mode), &b.TimeZone, &b.ExternalID, &b.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if samePhone {
+			candidate.Matches = append(candidate.Matches, "phone")
+		}
+		if sameEmail {
+			candidate.Matches = append(candidate.Matches, "email")
+		}
+		if sameWebsite {
+			candidate.Matches = append(candidate.Matches, "website")
+		}
+		candidate.Schools = [2]*School{&a, &b}
+		candidates = append(candidates, &candidate)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return candidates, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// InsertRevision() records a snapshot of the school as it is now
+func (m SchoolModel) InsertRevision(ctx context.Context, school *School, reason string) (err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.InsertRevision", "insert_school_revision")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	snapshot, err := json.Marshal(school)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO school_revisions(school_id, version, reason, snapshot)
+	VALUES ($1, $2, $3, $4)
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	//jsonb must be sent as text, lib/pq sends []byte as bytea
+	_, err = m.DB.ExecContext(ctx, query, school.ID, school.Version, reason, string(snapshot))
+	return err
+}
+
+// GetRevisions() returns the revisions of a school and of the schools merged into it, newest first
+func (m SchoolModel) GetRevisions(ctx context.Context, schoolID int64) (_ []*SchoolRevision, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.GetRevisions", "select_school_revisions")
+	revisions := []*SchoolRevision{}
+	defer func() { finishSpan(span, len(revisions), err) }()
+
+	query := `
+	SELECT id, created_at, school_id, version, reason, snapshot
+	FROM school_revisions
+	WHERE school_id = $1
+	OR school_id IN (SELECT merged_id FROM school_merges WHERE into_id = $1)
+	ORDER BY id DESC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, schoolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var revision SchoolRevision
+		var snapshot []byte
+		err := rows.Scan(
+			&revision.ID,
+			&revision.CreatedAt,
+			&revision.SchoolID,
+			&revision.Version,
+			&revision.Reason,
+			&snapshot,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, &revision.School); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// RecordMerge() redirects mergedID, and every id already redirected to it, to intoID.
+// It must be called before the merged school is deleted
+func (m SchoolModel) RecordMerge(ctx context.Context, mergedID, intoID int64) (err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.RecordMerge", "insert_school_merge")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	WITH repointed AS (
+		UPDATE school_merges SET into_id = $2 WHERE into_id = $1
+	)
+	INSERT INTO school_merges(merged_id, into_id)
+	VALUES ($1, $2)
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, mergedID, intoID)
+	return err
+}
+
+// MergedInto() returns the id of the school that the school with the given id was merged into
+func (m SchoolModel) MergedInto(ctx context.Context, id int64) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.MergedInto", "select_school_merge")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	SELECT into_id
+	FROM school_merges
+	WHERE merged_id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var intoID int64
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(&intoID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrorRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return intoID, nil
+}
@@ -0,0 +1,37 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// SchemaVersion is the migration version this build of the API expects.
+// Bump it whenever a new file is added to the migrations directory
+const SchemaVersion = 16
+
+// MigrationModel reads the schema_migrations table maintained by the migrate tool
+type MigrationModel struct {
+	DB *sql.DB
+}
+
+// Version() returns the current migration version and whether the last migration left it dirty
+func (m MigrationModel) Version(ctx context.Context) (int64, bool, error) {
+	query := `
+	SELECT version, dirty
+	FROM schema_migrations
+	LIMIT 1
+	`
+	var version int64
+	var dirty bool
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+	return version, dirty, nil
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+
+	"github.com/kirwadee/appletree/internal/tracing"
 )
 
 var (
@@ -10,14 +13,126 @@ var (
 	ErrEditConflict     = errors.New("edit conflict")
 )
 
+// querier is satisfied by both *sql.DB and *sql.Tx, so a model holding one
+// can run its statements inside a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // A wrapper for our data models
 type Models struct {
-	Schools SchoolModel
+	db          *sql.DB
+	tx          *sql.Tx //set on the copy Transaction() hands to fn
+	Schools     SchoolModel
+	Attachments AttachmentModel
+	Campuses    CampusModel
+	Programs    ProgramModel
+	Calendar    CalendarModel
+	Changes     ChangeModel
+	Idempotency IdempotencyKeyModel
+	Jobs        JobModel
+	Migrations  MigrationModel
+	Webhooks    WebhookModel
+	Deliveries  WebhookDeliveryModel
 }
 
 // NewModels() allows us to create a new Models
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Schools: SchoolModel{DB: db},
+		db:          db,
+		Schools:     SchoolModel{DB: db},
+		Attachments: AttachmentModel{DB: db},
+		Campuses:    CampusModel{DB: db},
+		Programs:    ProgramModel{DB: db},
+		Calendar:    CalendarModel{DB: db},
+		Changes:     ChangeModel{DB: db},
+		Idempotency: IdempotencyKeyModel{DB: db},
+		Jobs:        JobModel{DB: db},
+		Migrations:  MigrationModel{DB: db},
+		Webhooks:    WebhookModel{DB: db},
+		Deliveries:  WebhookDeliveryModel{DB: db},
+	}
+}
+
+// Transaction() calls fn with a copy of the models whose Schools, Attachments,
+// Campuses, Programs, Calendar and Jobs run on a single transaction. The transaction is committed if fn
+// returns nil and rolled back otherwise
+func (m Models) Transaction(ctx context.Context, fn func(tx Models) error) (err error) {
+	ctx, span := startSpan(ctx, "Models.Transaction", "transaction")
+	defer func() { finishSpan(span, 0, err) }()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	//a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	bound := m
+	bound.tx = tx
+	bound.Schools = SchoolModel{DB: tx}
+	bound.Attachments = AttachmentModel{DB: tx}
+	bound.Campuses = CampusModel{DB: tx}
+	bound.Programs = ProgramModel{DB: tx}
+	bound.Calendar = CalendarModel{DB: tx}
+	bound.Jobs = JobModel{DB: tx}
+	if err = fn(bound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Savepoint() runs fn under a savepoint of the transaction the models are bound
+// to. If fn returns keep as false everything it did is rolled back, which also
+// recovers the transaction after a statement in fn failed, and the transaction
+// carries on. It can only be called on the models passed to a Transaction() fn
+func (m Models) Savepoint(ctx context.Context, fn func() (keep bool, err error)) (err error) {
+	ctx, span := startSpan(ctx, "Models.Savepoint", "savepoint")
+	defer func() { finishSpan(span, 0, err) }()
+
+	if m.tx == nil {
+		return errors.New("savepoint outside of a transaction")
+	}
+	if _, err = m.tx.ExecContext(ctx, "SAVEPOINT models_savepoint"); err != nil {
+		return err
+	}
+	keep, err := fn()
+	if err != nil {
+		return err
+	}
+	if !keep {
+		if _, err = m.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT models_savepoint"); err != nil {
+			return err
+		}
+	}
+	_, err = m.tx.ExecContext(ctx, "RELEASE SAVEPOINT models_savepoint")
+	return err
+}
+
+// startSpan() begins a tracing span around a model call, tagged with the name of the SQL statement
+func startSpan(ctx context.Context, name, statement string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(ctx, name)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement.name", statement)
+	return ctx, span
+}
+
+// finishSpan() records the number of rows a model call affected and ends its span.
+// ErrorRecordNotFound and ErrEditConflict are expected outcomes rather than failures
+func finishSpan(span *tracing.Span, rows int, err error) {
+	span.SetAttribute("db.rows", rows)
+	if err != nil && !errors.Is(err, ErrorRecordNotFound) && !errors.Is(err, ErrEditConflict) {
+		span.RecordError(err)
+	}
+	span.Finish()
+}
+
+// rowCount() returns the number of rows touched by a single-row statement
+func rowCount(err error) int {
+	if err != nil {
+		return 0
 	}
+	return 1
 }
@@ -0,0 +1,259 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/validator"
+)
+
+// Program is a programme a school offers, for children within an age range,
+// with a number of seats for one term
+type Program struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	SchoolID  int64     `json:"school_id"`
+	Name      string    `json:"name"`
+	MinAge    int       `json:"min_age"`
+	MaxAge    int       `json:"max_age"`
+	Capacity  int       `json:"capacity"`
+	Enrolled  int       `json:"enrolled"`
+	//capacity less enrolled, filled in by the database
+	SeatsAvailable int `json:"seats_available"`
+	//per term, in the smallest unit of the currency
+	Fees int64 `json:"fees"`
+	//YYYY-MM-DD
+	TermStart string `json:"term_start"`
+	TermEnd   string `json:"term_end"`
+	Version   int32  `json:"version"`
+}
+
+func ValidateProgram(v *validator.Validator, program *Program) {
+	v.Check(program.Name != "", "name", "must be provided")
+	v.Check(len(program.Name) <= 200, "name", "must not be more than 200 bytes long")
+
+	v.Check(validator.Between(program.MinAge, 0, 99), "min_age", "must be between 0 and 99")
+	v.Check(validator.Between(program.MaxAge, 0, 99), "max_age", "must be between 0 and 99")
+	v.Check(program.MaxAge >= program.MinAge, "max_age", "must not be less than min_age")
+
+	v.Check(validator.Between(program.Capacity, 1, 10000), "capacity", "must be between 1 and 10000")
+	v.Check(validator.Between(program.Enrolled, 0, program.Capacity), "enrolled", "must be between 0 and capacity")
+
+	v.Check(program.Fees >= 0, "fees", "must not be negative")
+
+	v.Check(validator.ValidDate(program.TermStart), "term_start", "must be a date in YYYY-MM-DD format")
+	v.Check(validator.ValidDate(program.TermEnd), "term_end", "must be a date in YYYY-MM-DD format")
+	v.Check(validator.NotBefore(program.TermStart, program.TermEnd), "term_end", "must not be before term_start")
+}
+
+// Define a ProgramModel which wraps a sql.DB connection pool or a transaction
+type ProgramModel struct {
+	DB querier
+}
+
+// Insert() adds a program to a school
+func (m ProgramModel) Insert(ctx context.Context, program *Program) (err error) {
+	ctx, span := startSpan(ctx, "ProgramModel.Insert", "insert_program")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO programs(school_id, name, min_age, max_age, capacity, enrolled, fees, term_start, term_end)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id, created_at, capacity - enrolled, version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{
+		program.SchoolID,
+		program.Name,
+		program.MinAge,
+		program.MaxAge,
+		program.Capacity,
+		program.Enrolled,
+		program.Fees,
+		program.TermStart,
+		program.TermEnd,
+	}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&program.ID, &program.CreatedAt, &program.SeatsAvailable, &program.Version)
+}
+
+// Get() returns a program, provided it belongs to the given school
+func (m ProgramModel) Get(ctx context.Context, schoolID, id int64) (_ *Program, err error) {
+	ctx, span := startSpan(ctx, "ProgramModel.Get", "select_program")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	SELECT id, created_at, school_id, name, min_age, max_age, capacity, enrolled, capacity - enrolled, fees,
+	       to_char(term_start, 'YYYY-MM-DD'), to_char(term_end, 'YYYY-MM-DD'), version
+	FROM programs
+	WHERE id = $1 AND school_id = $2
+	`
+	var program Program
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(ctx, query, id, schoolID).Scan(
+		&program.ID,
+		&program.CreatedAt,
+		&program.SchoolID,
+		&program.Name,
+		&program.MinAge,
+		&program.MaxAge,
+		&program.Capacity,
+		&program.Enrolled,
+		&program.SeatsAvailable,
+		&program.Fees,
+		&program.TermStart,
+		&program.TermEnd,
+		&program.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &program, nil
+}
+
+// GetAllForSchool() returns every program of a school, by term and then age
+func (m ProgramModel) GetAllForSchool(ctx context.Context, schoolID int64) (_ []*Program, err error) {
+	ctx, span := startSpan(ctx, "ProgramModel.GetAllForSchool", "select_school_programs")
+	programs := []*Program{}
+	defer func() { finishSpan(span, len(programs), err) }()
+
+	query := `
+	SELECT id, created_at, school_id, name, min_age, max_age, capacity, enrolled, capacity - enrolled, fees,
+	       to_char(term_start, 'YYYY-MM-DD'), to_char(term_end, 'YYYY-MM-DD'), version
+	FROM programs
+	WHERE school_id = $1
+	ORDER BY term_start ASC, min_age ASC, id ASC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, schoolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var program Program
+		err := rows.Scan(
+			&program.ID,
+			&program.CreatedAt,
+			&program.SchoolID,
+			&program.Name,
+			&program.MinAge,
+			&program.MaxAge,
+			&program.Capacity,
+			&program.Enrolled,
+			&program.SeatsAvailable,
+			&program.Fees,
+			&program.TermStart,
+			&program.TermEnd,
+			&program.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		programs = append(programs, &program)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return programs, nil
+}
+
+// Update() saves changes to a program, with optimistic locking on its version number
+func (m ProgramModel) Update(ctx context.Context, program *Program) (err error) {
+	ctx, span := startSpan(ctx, "ProgramModel.Update", "update_program")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE programs
+	SET name = $1, min_age = $2, max_age = $3, capacity = $4, enrolled = $5, fees = $6,
+	    term_start = $7, term_end = $8, version = version + 1
+	WHERE id = $9 AND school_id = $10 AND version = $11
+	RETURNING capacity - enrolled, version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{
+		program.Name,
+		program.MinAge,
+		program.MaxAge,
+		program.Capacity,
+		program.Enrolled,
+		program.Fees,
+		program.TermStart,
+		program.TermEnd,
+		program.ID,
+		program.SchoolID,
+		program.Version,
+	}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&program.SeatsAvailable, &program.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a program from a school
+func (m ProgramModel) Delete(ctx context.Context, schoolID, id int64) (err error) {
+	ctx, span := startSpan(ctx, "ProgramModel.Delete", "delete_program")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || schoolID < 1 {
+		return ErrorRecordNotFound
+	}
+	query := `
+	DELETE FROM programs
+	WHERE id = $1 AND school_id = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, schoolID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
+
+// MoveAll() hands every program of one school over to another and returns how many were moved
+func (m ProgramModel) MoveAll(ctx context.Context, fromSchoolID, toSchoolID int64) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "ProgramModel.MoveAll", "update_programs_school")
+	var rowsAffected int64
+	defer func() { finishSpan(span, int(rowsAffected), err) }()
+
+	query := `
+	UPDATE programs
+	SET school_id = $2
+	WHERE school_id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, fromSchoolID, toSchoolID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err = result.RowsAffected()
+	return rowsAffected, err
+}
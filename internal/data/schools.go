@@ -11,6 +11,9 @@ import (
 	"github.com/lib/pq"
 )
 
+// ErrDuplicateExternalID is returned when another school already has the external ID
+var ErrDuplicateExternalID = errors.New("duplicate external id")
+
 type School struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
@@ -22,7 +25,14 @@ type School struct {
 	Website   string    `json:"website,omitempty"`
 	Address   string    `json:"address"`
 	Mode      []string  `json:"mode"`
-	Version   int32     `json:"version"`
+	//an IANA time zone name, the school's opening hours are local to it
+	TimeZone string `json:"time_zone"`
+	//the school's code in the ministry registry, if it has one
+	ExternalID string `json:"external_id,omitempty"`
+	Version    int32  `json:"version"`
+	//only filled in by GetAll(), the newest logo that has a thumbnail
+	LogoAttachmentID int64  `json:"-"`
+	LogoThumbnailURL string `json:"logo_thumbnail_url,omitempty"`
 }
 
 func ValidateSchool(v *validator.Validator, school *School) {
@@ -39,11 +49,9 @@ func ValidateSchool(v *validator.Validator, school *School) {
 	v.Check(school.Phone != "", "phone", "must be provided")
 	v.Check(validator.Matches(school.Phone, validator.PhoneRx), "phone", "must be a valid phone number")
 
-	v.Check(school.Email != "", "email", "must be provided")
-	v.Check(validator.Matches(school.Email, validator.EmailRx), "Email", "must be a valid Email address")
-
-	v.Check(school.Website != "", "website", "must be provided")
-	v.Check(validator.ValidWebsite(school.Website), "Website", "must be a valid URL")
+	//email and website are optional, a patch can clear them
+	v.Check(school.Email == "" || validator.Matches(school.Email, validator.EmailRx), "Email", "must be a valid Email address")
+	v.Check(school.Website == "" || validator.ValidWebsite(school.Website), "Website", "must be a valid URL")
 
 	v.Check(school.Address != "", "address", "must be provided")
 	v.Check(len(school.Address) <= 500, "address", "must not be more than 500 bytes long")
@@ -52,22 +60,30 @@ func ValidateSchool(v *validator.Validator, school *School) {
 	v.Check(len(school.Mode) >= 1, "mode", "must contain at least 1 entry")
 	v.Check(len(school.Mode) <= 5, "mode", "must contain at most 5 entries")
 	v.Check(validator.Unique(school.Mode), "mode", "must not contain duplicate entries")
+
+	//an empty time zone is saved as UTC
+	v.Check(school.TimeZone == "" || validator.ValidTimeZone(school.TimeZone), "time_zone", "must be a valid IANA time zone name")
+
+	v.Check(len(school.ExternalID) <= 100, "external_id", "must not be more than 100 bytes long")
 }
 
-// Define a SchoolModel which wraps a sql.DB connection pool
+// Define a SchoolModel which wraps a sql.DB connection pool or a transaction
 type SchoolModel struct {
-	DB *sql.DB
+	DB querier
 }
 
 // Insert() allows us to create a new school
-func (m SchoolModel) Insert(school *School) error {
+func (m SchoolModel) Insert(ctx context.Context, school *School) (err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.Insert", "insert_school")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
 	query := `
-	INSERT INTO schools(name, level, contact, phone, email, website, address, mode)
-	VALUES ($1, $2, $3, $4 ,$5, $6, $7, $8)
-	RETURNING id, created_at, version
+	INSERT INTO schools(name, level, contact, phone, email, website, address, mode, external_id, time_zone)
+	VALUES ($1, $2, $3, $4 ,$5, $6, $7, $8, NULLIF($9, ''), COALESCE(NULLIF($10, ''), 'UTC'))
+	RETURNING id, created_at, time_zone, version
 	`
 	//create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	//clean up to prevent memory leaks
 	defer cancel()
 	//Execute the query using QueryRowContext()
@@ -77,32 +93,38 @@ func (m SchoolModel) Insert(school *School) error {
 		school.Contact, school.Phone,
 		school.Email, school.Website,
 		school.Address, pq.Array(school.Mode),
+		school.ExternalID, school.TimeZone,
 	}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&school.ID, &school.CreatedAt, &school.Version)
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&school.ID, &school.CreatedAt, &school.TimeZone, &school.Version)
+	return externalIDError(err)
 
 }
 
 // Get() allows us to retrieve a specific school
-func (m SchoolModel) Get(id int64) (*School, error) {
+func (m SchoolModel) Get(ctx context.Context, id int64) (_ *School, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.Get", "select_school")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
 	//Ensure that there is a valid id
 	if id < 1 {
 		return nil, ErrorRecordNotFound
 	}
 	//Create the query
 	query := `
-	 SELECT id, created_at, name, level, contact, phone, email, website, address, mode, version
+	 SELECT id, created_at, name, level, contact, phone, email, website, address, mode, time_zone,
+	        COALESCE(external_id, ''), version
 	 FROM schools
 	 WHERE id = $1
 	`
 	//Declare a school variale to hold returned data
 	var school School
 	//create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	//clean up to prevent memory leaks
 	defer cancel()
 	//Execute the query using QueryRowContext()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(
 		&school.ID,
 		&school.CreatedAt,
 		&school.Name,
@@ -113,6 +135,8 @@ func (m SchoolModel) Get(id int64) (*School, error) {
 		&school.Website,
 		&school.Address,
 		pq.Array(&school.Mode),
+		&school.TimeZone,
+		&school.ExternalID,
 		&school.Version,
 	)
 	//handle any errors
@@ -129,20 +153,116 @@ func (m SchoolModel) Get(id int64) (*School, error) {
 	return &school, nil
 }
 
+// GetByExternalID() retrieves the school with the given external ID
+func (m SchoolModel) GetByExternalID(ctx context.Context, externalID string) (_ *School, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.GetByExternalID", "select_school_by_external_id")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if externalID == "" {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	 SELECT id, created_at, name, level, contact, phone, email, website, address, mode, time_zone,
+	        external_id, version
+	 FROM schools
+	 WHERE external_id = $1
+	`
+	var school School
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(ctx, query, externalID).Scan(
+		&school.ID,
+		&school.CreatedAt,
+		&school.Name,
+		&school.Level,
+		&school.Contact,
+		&school.Phone,
+		&school.Email,
+		&school.Website,
+		&school.Address,
+		pq.Array(&school.Mode),
+		&school.TimeZone,
+		&school.ExternalID,
+		&school.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &school, nil
+}
+
+// Upsert() creates a school with school.ExternalID, or replaces the school
+// that already has it. A school that already matches is left untouched, so
+// its version stays the same and no change is recorded for it. created and
+// changed report which of these happened
+func (m SchoolModel) Upsert(ctx context.Context, school *School) (created, changed bool, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.Upsert", "upsert_school")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO schools(name, level, contact, phone, email, website, address, mode, external_id, time_zone)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE(NULLIF($10, ''), 'UTC'))
+	ON CONFLICT (external_id) DO UPDATE
+	SET name=EXCLUDED.name, level=EXCLUDED.level, contact=EXCLUDED.contact, phone=EXCLUDED.phone,
+	    email=EXCLUDED.email, website=EXCLUDED.website, address=EXCLUDED.address, mode=EXCLUDED.mode,
+	    time_zone=EXCLUDED.time_zone, version=schools.version + 1
+	WHERE (schools.name, schools.level, schools.contact, schools.phone,
+	       schools.email, schools.website, schools.address, schools.mode, schools.time_zone)
+	IS DISTINCT FROM (EXCLUDED.name, EXCLUDED.level, EXCLUDED.contact, EXCLUDED.phone,
+	       EXCLUDED.email, EXCLUDED.website, EXCLUDED.address, EXCLUDED.mode, EXCLUDED.time_zone)
+	RETURNING id, created_at, time_zone, version, xmax = 0
+	`
+	args := []interface{}{
+		school.Name, school.Level,
+		school.Contact, school.Phone,
+		school.Email, school.Website,
+		school.Address, pq.Array(school.Mode),
+		school.ExternalID, school.TimeZone,
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(queryCtx, query, args...).Scan(&school.ID, &school.CreatedAt, &school.TimeZone, &school.Version, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		//the WHERE clause skipped the update, so read back what is stored
+		existing, err := m.GetByExternalID(ctx, school.ExternalID)
+		if err != nil {
+			return false, false, err
+		}
+		school.ID = existing.ID
+		school.CreatedAt = existing.CreatedAt
+		school.TimeZone = existing.TimeZone
+		school.Version = existing.Version
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return created, true, nil
+}
+
 // Update() allows us to edit/alter a specific school
 // Optimistic locking on version number
-func (m SchoolModel) Update(school *School) error {
+func (m SchoolModel) Update(ctx context.Context, school *School) (err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.Update", "update_school")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
 	query := `
 	UPDATE schools
 	SET name=$1, level=$2, contact=$3, phone=$4,
 	    email=$5, website=$6, address=$7, mode=$8,
+	    external_id=NULLIF($11, ''), time_zone=COALESCE(NULLIF($12, ''), 'UTC'),
 		version=version + 1
 	WHERE id=$9 
 	AND version = $10
-	RETURNING version
+	RETURNING time_zone, version
 	`
 	//create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	//clean up to prevent memory leaks
 	defer cancel()
 	//Execute the query using QueryRowContext()
@@ -158,28 +278,33 @@ func (m SchoolModel) Update(school *School) error {
 		pq.Array(school.Mode),
 		school.ID,
 		school.Version,
+		school.ExternalID,
+		school.TimeZone,
 	}
 	//check for edit conflicts
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&school.Version)
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&school.TimeZone, &school.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return externalIDError(err)
 		}
 	}
 	return nil
 }
 
 // Delete() removes a specific school
-func (m SchoolModel) Delete(id int64) error {
+func (m SchoolModel) Delete(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.Delete", "delete_school")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
 	//Ensure the id is valid first
 	if id < 1 {
 		return ErrorRecordNotFound
 	}
 	//create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	//clean up to prevent memory leaks
 	defer cancel()
 	//Execute the query using QueryRowContext()
@@ -208,22 +333,126 @@ func (m SchoolModel) Delete(id int64) error {
 	return nil
 }
 
+// DeleteVersion() deletes a school only if it is still at the given version,
+// returning ErrEditConflict if it has changed or gone in the meantime
+func (m SchoolModel) DeleteVersion(ctx context.Context, id int64, version int32) (err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.DeleteVersion", "delete_school_version")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	DELETE FROM schools
+	WHERE id = $1
+	AND version = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, version)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// externalIDError() turns a unique violation on the external ID into ErrDuplicateExternalID
+func externalIDError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "schools_external_id_key" {
+		return ErrDuplicateExternalID
+	}
+	return err
+}
+
+// SchoolSearch holds the ways GetAll() can narrow the list of schools. Age and
+// HasCapacity match schools with a program that takes children of that age or
+// has seats left, and when both are set the same program must satisfy both.
+// OpenAt matches schools open at that moment by their opening hours and
+// closures. When OpenAtLocal is set its date and clock time are read in each
+// school's own time zone instead
+type SchoolSearch struct {
+	Name        string
+	Level       string
+	Mode        []string
+	Age         *int
+	HasCapacity bool
+	OpenAt      *time.Time
+	OpenAtLocal bool
+}
+
 // The GetAll() method returns a list of all schools sorted by the id
-func (m SchoolModel) GetAll(name, level string, mode []string, filters Filters) ([]*School, Metadata, error) {
+func (m SchoolModel) GetAll(ctx context.Context, search SchoolSearch, filters Filters) (_ []*School, _ Metadata, err error) {
+	ctx, span := startSpan(ctx, "SchoolModel.GetAll", "select_schools")
+	schools := []*School{}
+	defer func() { finishSpan(span, len(schools), err) }()
+
 	//construct the query
 	query := fmt.Sprintf(`
-	 SELECT COUNT(*) OVER(), id, created_at, name, level, contact, phone, email, website, address, mode, version
+	 SELECT COUNT(*) OVER(), id, created_at, name, level, contact, phone, email, website, address, mode,
+	        time_zone, COALESCE(external_id, ''), version, COALESCE(logo.logo_id, 0)
 	 FROM schools
+	 LEFT JOIN LATERAL (
+	   SELECT id AS logo_id FROM attachments
+	   WHERE school_id = schools.id AND kind = 'logo' AND thumbnail_key <> ''
+	   ORDER BY id DESC
+	   LIMIT 1
+	 ) logo ON true
+	 LEFT JOIN LATERAL (
+	   SELECT true AS matched FROM programs
+	   WHERE school_id = schools.id
+	   AND ($6::integer IS NULL OR $6 BETWEEN min_age AND max_age)
+	   AND (NOT $7 OR enrolled < capacity)
+	   LIMIT 1
+	 ) program ON true
+	 CROSS JOIN LATERAL (
+	   SELECT COALESCE($8::timestamp, $9::timestamptz AT TIME ZONE schools.time_zone) AS local_time
+	 ) open_at
 	 WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 ='')
 	 AND (to_tsvector('simple', level) @@ plainto_tsquery('simple', $2) OR $2 ='')
 	 AND (mode @> $3  OR $3 = '{}')
+	 AND (program.matched OR ($6 IS NULL AND NOT $7))
+	 AND (open_at.local_time IS NULL OR (
+	   EXISTS (
+	     SELECT 1 FROM opening_hours
+	     WHERE school_id = schools.id
+	     AND weekday = extract(dow FROM open_at.local_time)
+	     AND open_at.local_time::time >= opens_at AND open_at.local_time::time < closes_at
+	   )
+	   AND NOT EXISTS (
+	     SELECT 1 FROM school_closures
+	     WHERE school_id = schools.id
+	     AND open_at.local_time::date BETWEEN starts_on AND ends_on
+	   )
+	 ))
 	 ORDER BY %s %s, id ASC
 	 LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
 
 	//create a 3 seconds timeout context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	//a local time goes in as a timestamp without time zone, an instant as one with
+	var openAtLocal, openAtInstant *time.Time
+	if search.OpenAtLocal {
+		openAtLocal = search.OpenAt
+	} else {
+		openAtInstant = search.OpenAt
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	args := []interface{}{name, level, pq.Array(mode), filters.limit(), filters.offset()}
+	args := []interface{}{
+		search.Name,
+		search.Level,
+		pq.Array(search.Mode),
+		filters.limit(),
+		filters.offset(),
+		search.Age,
+		search.HasCapacity,
+		openAtLocal,
+		openAtInstant,
+	}
 	//Execute the query
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -232,8 +461,6 @@ func (m SchoolModel) GetAll(name, level string, mode []string, filters Filters)
 	//close the result set to save resources
 	defer rows.Close()
 	totalRecords := 0
-	//initialize an empty slice to hold school data
-	schools := []*School{}
 	//iterate over rows in the resultset
 	for rows.Next() {
 		var school School
@@ -250,7 +477,10 @@ func (m SchoolModel) GetAll(name, level string, mode []string, filters Filters)
 			&school.Website,
 			&school.Address,
 			pq.Array(&school.Mode),
+			&school.TimeZone,
+			&school.ExternalID,
 			&school.Version,
+			&school.LogoAttachmentID,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
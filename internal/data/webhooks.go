@@ -0,0 +1,371 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/validator"
+	"github.com/lib/pq"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to
+var WebhookEvents = []string{"school.created", "school.updated", "school.deleted"}
+
+// The states of a webhook delivery. A delivery that keeps failing is retried
+// by the job queue until it is dead-lettered, and stays failed
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a subscription that receives the events it lists as signed POST requests
+type Webhook struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"-"`
+	Description string    `json:"description,omitempty"`
+	Active      bool      `json:"active"`
+	Version     int32     `json:"version"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	u, err := url.Parse(webhook.URL)
+	v.Check(webhook.URL == "" || (err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""), "url", "must be an absolute http or https URL")
+	v.Check(err != nil || validator.PublicHost(u.Hostname()), "url", "must not point to a loopback, link-local or private address")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 entry")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate entries")
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", "must only contain school.created, school.updated or school.deleted")
+	}
+
+	v.Check(len(webhook.Secret) >= 16, "secret", "must be at least 16 bytes long")
+	v.Check(len(webhook.Secret) <= 200, "secret", "must not be more than 200 bytes long")
+	v.Check(len(webhook.Description) <= 500, "description", "must not be more than 500 bytes long")
+}
+
+// WebhookDelivery records an event sent, or to be sent, to a webhook and the outcome of the last attempt
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	EventID        string          `json:"event_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	ReplayOf       *int64          `json:"replay_of,omitempty"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	ResponseBody   string          `json:"response_body,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	DurationMS     int             `json:"duration_ms"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at,omitempty"`
+}
+
+// Define a WebhookModel which wraps a sql.DB connection pool
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates a new webhook subscription
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) (err error) {
+	ctx, span := startSpan(ctx, "WebhookModel.Insert", "insert_webhook")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	INSERT INTO webhooks(url, events, secret, description, active)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at, version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{webhook.URL, pq.Array(webhook.Events), webhook.Secret, webhook.Description, webhook.Active}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Get() retrieves a specific webhook
+func (m WebhookModel) Get(ctx context.Context, id int64) (_ *Webhook, err error) {
+	ctx, span := startSpan(ctx, "WebhookModel.Get", "select_webhook")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	SELECT id, created_at, url, events, secret, description, active, version
+	FROM webhooks
+	WHERE id = $1
+	`
+	var webhook Webhook
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Secret,
+		&webhook.Description,
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+// GetAll() returns every webhook, or only the active ones subscribed to event when it isn't empty
+func (m WebhookModel) GetAll(ctx context.Context, event string) (_ []*Webhook, err error) {
+	ctx, span := startSpan(ctx, "WebhookModel.GetAll", "select_webhooks")
+	webhooks := []*Webhook{}
+	defer func() { finishSpan(span, len(webhooks), err) }()
+
+	query := `
+	SELECT id, created_at, url, events, secret, description, active, version
+	FROM webhooks
+	WHERE $1 = '' OR (active AND events @> ARRAY[$1])
+	ORDER BY id ASC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Secret,
+			&webhook.Description,
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// Update() saves changes to a webhook, guarding against edit conflicts with its version
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) (err error) {
+	ctx, span := startSpan(ctx, "WebhookModel.Update", "update_webhook")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE webhooks
+	SET url = $1, events = $2, secret = $3, description = $4, active = $5, version = version + 1
+	WHERE id = $6 AND version = $7
+	RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{
+		webhook.URL, pq.Array(webhook.Events), webhook.Secret,
+		webhook.Description, webhook.Active, webhook.ID, webhook.Version,
+	}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a webhook along with its delivery log
+func (m WebhookModel) Delete(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "WebhookModel.Delete", "delete_webhook")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 {
+		return ErrorRecordNotFound
+	}
+	query := `
+	DELETE FROM webhooks
+	WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
+
+// Define a WebhookDeliveryModel which wraps a sql.DB connection pool
+type WebhookDeliveryModel struct {
+	DB *sql.DB
+}
+
+const deliveryColumns = `id, created_at, webhook_id, event_id, event, payload, replay_of, status, attempts,
+	response_status, response_body, error, duration_ms, last_attempt_at`
+
+func scanDelivery(row interface{ Scan(...any) error }, delivery *WebhookDelivery, extra ...any) error {
+	dest := append(extra,
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.WebhookID,
+		&delivery.EventID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.ReplayOf,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseStatus,
+		&delivery.ResponseBody,
+		&delivery.Error,
+		&delivery.DurationMS,
+		&delivery.LastAttemptAt,
+	)
+	return row.Scan(dest...)
+}
+
+// Insert() records a pending delivery. Each event is only recorded once per
+// webhook, apart from replays, so it returns false when the delivery already
+// existed and reads the existing row into delivery
+func (m WebhookDeliveryModel) Insert(ctx context.Context, delivery *WebhookDelivery) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "WebhookDeliveryModel.Insert", "insert_webhook_delivery")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	//the no-op update makes RETURNING report the existing row on a conflict
+	query := `
+	INSERT INTO webhook_deliveries(webhook_id, event_id, event, payload, replay_of)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (webhook_id, event_id) WHERE replay_of IS NULL
+	DO UPDATE SET event = EXCLUDED.event
+	RETURNING (xmax = 0), ` + deliveryColumns
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{delivery.WebhookID, delivery.EventID, delivery.Event, string(delivery.Payload), delivery.ReplayOf}
+	var inserted bool
+	err = scanDelivery(m.DB.QueryRowContext(ctx, query, args...), delivery, &inserted)
+	return inserted, err
+}
+
+// Get() retrieves a specific delivery belonging to a webhook
+func (m WebhookDeliveryModel) Get(ctx context.Context, webhookID, id int64) (_ *WebhookDelivery, err error) {
+	ctx, span := startSpan(ctx, "WebhookDeliveryModel.Get", "select_webhook_delivery")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	if id < 1 || webhookID < 1 {
+		return nil, ErrorRecordNotFound
+	}
+	query := `
+	SELECT ` + deliveryColumns + `
+	FROM webhook_deliveries
+	WHERE id = $1 AND webhook_id = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var delivery WebhookDelivery
+	err = scanDelivery(m.DB.QueryRowContext(ctx, query, id, webhookID), &delivery)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &delivery, nil
+}
+
+// GetAllForWebhook() returns a page of a webhook's delivery log, newest first
+func (m WebhookDeliveryModel) GetAllForWebhook(ctx context.Context, webhookID int64, filters Filters) (_ []*WebhookDelivery, _ Metadata, err error) {
+	ctx, span := startSpan(ctx, "WebhookDeliveryModel.GetAllForWebhook", "select_webhook_deliveries")
+	deliveries := []*WebhookDelivery{}
+	defer func() { finishSpan(span, len(deliveries), err) }()
+
+	query := `
+	SELECT COUNT(*) OVER(), ` + deliveryColumns + `
+	FROM webhook_deliveries
+	WHERE webhook_id = $1
+	ORDER BY id DESC
+	LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := scanDelivery(rows, &delivery, &totalRecords); err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// RecordAttempt() saves the outcome of an attempt to deliver
+func (m WebhookDeliveryModel) RecordAttempt(ctx context.Context, delivery *WebhookDelivery) (err error) {
+	ctx, span := startSpan(ctx, "WebhookDeliveryModel.RecordAttempt", "update_webhook_delivery")
+	defer func() { finishSpan(span, rowCount(err), err) }()
+
+	query := `
+	UPDATE webhook_deliveries
+	SET status = $1, attempts = attempts + 1, response_status = $2, response_body = $3,
+	    error = $4, duration_ms = $5, last_attempt_at = NOW()
+	WHERE id = $6
+	RETURNING attempts, last_attempt_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	args := []interface{}{
+		delivery.Status, delivery.ResponseStatus, delivery.ResponseBody,
+		delivery.Error, delivery.DurationMS, delivery.ID,
+	}
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&delivery.Attempts, &delivery.LastAttemptAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status values reported for each check and for the overall result
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+)
+
+// A CheckFunc performs a single health check. It may return details that
+// are reported alongside the status, and a non-nil error when the check fails
+type CheckFunc func(ctx context.Context) (map[string]any, error)
+
+// Result holds the outcome of a single check
+type Result struct {
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Duration string         `json:"duration"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Registry holds the named checks that make up a readiness probe
+type Registry struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	checks  []check
+}
+
+// The New() function creates a Registry whose checks each run with the given timeout
+func New(timeout time.Duration) *Registry {
+	return &Registry{timeout: timeout}
+}
+
+// Register() adds a named check to the registry
+func (r *Registry) Register(name string, fn CheckFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, check{name: name, fn: fn})
+}
+
+// Run() executes every check concurrently and reports whether all of them passed
+func (r *Registry) Run(ctx context.Context) (bool, map[string]Result) {
+	r.mu.Lock()
+	checks := append([]check(nil), r.checks...)
+	r.mu.Unlock()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		healthy = true
+		results = make(map[string]Result, len(checks))
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+			result := r.run(ctx, c)
+			mu.Lock()
+			defer mu.Unlock()
+			if result.Status != StatusPass {
+				healthy = false
+			}
+			results[c.name] = result
+		}(c)
+	}
+	wg.Wait()
+	return healthy, results
+}
+
+// run() executes a single check, enforcing the registry timeout
+func (r *Registry) run(ctx context.Context, c check) Result {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	type outcome struct {
+		details map[string]any
+		err     error
+	}
+	start := time.Now()
+	done := make(chan outcome, 1)
+	go func() {
+		details, err := c.fn(ctx)
+		done <- outcome{details, err}
+	}()
+
+	var o outcome
+	select {
+	case o = <-done:
+	case <-ctx.Done():
+		o.err = ctx.Err()
+	}
+
+	result := Result{
+		Status:   StatusPass,
+		Duration: time.Since(start).String(),
+		Details:  o.details,
+	}
+	if o.err != nil {
+		result.Status = StatusFail
+		result.Error = o.err.Error()
+	}
+	return result
+}
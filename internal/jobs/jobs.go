@@ -0,0 +1,324 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kirwadee/appletree/internal/data"
+	"github.com/kirwadee/appletree/internal/jsonlog"
+	"github.com/kirwadee/appletree/internal/tracing"
+)
+
+// Backoff bounds for failed jobs. The delay doubles with every attempt
+const (
+	minBackoff = 10 * time.Second
+	maxBackoff = time.Hour
+)
+
+// Options configure a Dispatcher
+type Options struct {
+	Concurrency  int           //jobs run at the same time
+	PollInterval time.Duration //how often to look for work when the queue is empty
+	Timeout      time.Duration //how long a single attempt may run
+	MaxAttempts  int           //attempts before a job is dead-lettered
+	Retention    time.Duration //how long completed jobs are kept
+}
+
+// handlerFunc decodes a job's payload and runs it
+type handlerFunc func(ctx context.Context, payload json.RawMessage) error
+
+// Dispatcher claims jobs from the jobs table and runs them with the handler registered for their kind
+type Dispatcher struct {
+	model   data.JobModel
+	logger  *jsonlog.Logger
+	tracer  *tracing.Tracer
+	opts    Options
+	lease   time.Duration
+	running atomic.Int64
+
+	handlers map[string]handlerFunc
+	kinds    []string
+
+	wake   chan struct{}
+	stop   chan struct{}
+	loop   sync.WaitGroup
+	active sync.WaitGroup
+	//ctx is cancelled when a shutdown runs out of time, aborting the running jobs
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// The New() function creates a Dispatcher. Register the handlers, then call Start()
+func New(model data.JobModel, logger *jsonlog.Logger, tracer *tracing.Tracer, opts Options) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		model:  model,
+		logger: logger.With(jsonlog.String("component", "jobs")),
+		tracer: tracer,
+		opts:   opts,
+		//a job is only claimed again once it has certainly timed out
+		lease:    2*opts.Timeout + time.Minute,
+		handlers: make(map[string]handlerFunc),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// permanentError marks a failure that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent() wraps an error so the job is dead-lettered straight away instead of retried
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Register() adds the handler for a kind of job. The payload is decoded into a
+// T before the handler is called. It must be called before Start()
+func Register[T any](d *Dispatcher, kind string, handler func(context.Context, T) error) {
+	if _, exists := d.handlers[kind]; exists {
+		panic("jobs: handler already registered for " + kind)
+	}
+	d.handlers[kind] = func(ctx context.Context, raw json.RawMessage) error {
+		var payload T
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return Permanent(fmt.Errorf("decoding payload: %w", err))
+		}
+		return handler(ctx, payload)
+	}
+	d.kinds = append(d.kinds, kind)
+}
+
+// Enqueue() stores a job to be run as soon as a worker is free
+func (d *Dispatcher) Enqueue(ctx context.Context, kind string, payload any) (*data.Job, error) {
+	return d.EnqueueAt(ctx, kind, payload, time.Time{})
+}
+
+// EnqueueAt() stores a job that won't run before runAt
+func (d *Dispatcher) EnqueueAt(ctx context.Context, kind string, payload any, runAt time.Time) (*data.Job, error) {
+	job, err := d.insert(ctx, d.model, kind, payload, runAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Notify()
+	return job, nil
+}
+
+// EnqueueIn() stores a job through model, which may be bound to a transaction
+// so that the job only exists if the transaction commits. Call Notify() once
+// it has, or the job waits for the next poll
+func (d *Dispatcher) EnqueueIn(ctx context.Context, model data.JobModel, kind string, payload any) (*data.Job, error) {
+	return d.insert(ctx, model, kind, payload, time.Time{})
+}
+
+// Notify() lets an idle dispatcher pick up new jobs without waiting for the next poll
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) insert(ctx context.Context, model data.JobModel, kind string, payload any, runAt time.Time) (*data.Job, error) {
+	if _, ok := d.handlers[kind]; !ok {
+		return nil, fmt.Errorf("jobs: no handler registered for %s", kind)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job := &data.Job{
+		Kind:        kind,
+		Payload:     raw,
+		MaxAttempts: d.opts.MaxAttempts,
+		RunAt:       runAt,
+	}
+	if err := model.Insert(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Running() returns the number of jobs currently being worked on
+func (d *Dispatcher) Running() int {
+	return int(d.running.Load())
+}
+
+// Concurrency() returns the most jobs that run at the same time
+func (d *Dispatcher) Concurrency() int {
+	return d.opts.Concurrency
+}
+
+// Start() begins claiming and running jobs in the background
+func (d *Dispatcher) Start() {
+	d.loop.Add(2)
+	go d.dispatch()
+	go d.prune()
+}
+
+// Shutdown() stops claiming new jobs and waits for the running ones to finish.
+// If ctx expires first the running jobs are cancelled. Their attempts are
+// recorded as failures and they are retried after a restart
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	close(d.stop)
+	d.loop.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		d.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// dispatch() claims jobs while there is a free slot, up to the concurrency limit
+func (d *Dispatcher) dispatch() {
+	defer d.loop.Done()
+	slots := make(chan struct{}, d.opts.Concurrency)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-d.stop:
+			return
+		}
+		job, err := d.model.Claim(context.Background(), d.kinds, d.lease)
+		if err != nil {
+			<-slots
+			if !errors.Is(err, data.ErrorRecordNotFound) {
+				d.logger.Error(err)
+			}
+			select {
+			case <-time.After(d.opts.PollInterval):
+			case <-d.wake:
+			case <-d.stop:
+				return
+			}
+			continue
+		}
+		d.active.Add(1)
+		d.running.Add(1)
+		go func() {
+			defer func() {
+				d.running.Add(-1)
+				d.active.Done()
+				<-slots
+			}()
+			d.run(job)
+		}()
+	}
+}
+
+// run() executes one attempt of a job and records the outcome
+func (d *Dispatcher) run(job *data.Job) {
+	ctx, span := d.tracer.Start(d.ctx, "job "+job.Kind, tracing.KindInternal)
+	span.SetAttribute("job.id", job.ID)
+	span.SetAttribute("job.kind", job.Kind)
+	span.SetAttribute("job.attempt", job.Attempts)
+	defer span.Finish()
+
+	start := time.Now()
+	err := d.execute(ctx, job)
+	fields := []jsonlog.Field{
+		jsonlog.Int64("job_id", job.ID),
+		jsonlog.String("kind", job.Kind),
+		jsonlog.Int("attempt", job.Attempts),
+		jsonlog.Duration("duration", time.Since(start)),
+	}
+
+	//record the outcome even if the shutdown cancelled the job
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	var permanent permanentError
+	switch {
+	case err == nil:
+		err = d.model.Complete(ctx, job)
+	case errors.As(err, &permanent), job.Attempts >= job.MaxAttempts:
+		span.RecordError(err)
+		d.logger.Error(err, append(fields, jsonlog.String("outcome", "dead"))...)
+		err = d.model.Bury(ctx, job, err.Error())
+	default:
+		span.RecordError(err)
+		retryAt := time.Now().Add(backoff(job.Attempts))
+		d.logger.Warn("job failed, will retry", append(fields, jsonlog.Err(err), jsonlog.Time("retry_at", retryAt))...)
+		err = d.model.Retry(ctx, job, retryAt, err.Error())
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrorRecordNotFound) {
+			d.logger.Warn("job lease expired before it finished", fields...)
+			return
+		}
+		d.logger.Error(err, fields...)
+	}
+}
+
+// execute() calls the job's handler, turning a panic into an error
+func (d *Dispatcher) execute(ctx context.Context, job *data.Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v\n%s", p, debug.Stack())
+		}
+	}()
+	handler, ok := d.handlers[job.Kind]
+	if !ok {
+		return Permanent(fmt.Errorf("no handler registered for %s", job.Kind))
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+	return handler(ctx, job.Payload)
+}
+
+// prune() removes completed jobs once they are older than the retention period
+func (d *Dispatcher) prune() {
+	defer d.loop.Done()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := d.model.DeleteFinished(context.Background(), time.Now().Add(-d.opts.Retention))
+			if err != nil {
+				d.logger.Error(err)
+				continue
+			}
+			if removed > 0 {
+				d.logger.Info("pruned completed jobs", jsonlog.Int64("removed", removed))
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// backoff() returns the delay before the next attempt, with up to 25% jitter so
+// jobs that failed together don't all retry together
+func backoff(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 20 {
+		delay = minBackoff << (attempt - 1)
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/4+1))
+}
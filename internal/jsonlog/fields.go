@@ -0,0 +1,71 @@
+package jsonlog
+
+import (
+	"time"
+)
+
+// Field is a typed key/value pair that is written to an entry's properties
+type Field struct {
+	Key   string
+	Value any
+}
+
+// String() creates a string field
+func String(key, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Int() creates an integer field
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Int64() creates a 64-bit integer field
+func Int64(key string, value int64) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Float64() creates a floating point field
+func Float64(key string, value float64) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Bool() creates a boolean field
+func Bool(key string, value bool) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Duration() creates a field holding a duration formatted like "1.5s"
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, Value: value.String()}
+}
+
+// Time() creates a field holding an RFC3339 timestamp
+func Time(key string, value time.Time) Field {
+	return Field{Key: key, Value: value.UTC().Format(time.RFC3339Nano)}
+}
+
+// Err() creates an "error" field holding the error's message
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: nil}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// Any() creates a field from any value that can be encoded as JSON
+func Any(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+// stringFields() converts the properties used by the Print* helpers into fields
+func stringFields(properties map[string]string) []Field {
+	if len(properties) == 0 {
+		return nil
+	}
+	fields := make([]Field, 0, len(properties))
+	for key, value := range properties {
+		fields = append(fields, String(key, value))
+	}
+	return fields
+}
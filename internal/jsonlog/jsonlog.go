@@ -1,30 +1,41 @@
 package jsonlog
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // we can have different severity levels of logging entries
 type Level int8
 
-// Levels start at zero
+// Levels start at zero with Info so that the zero value logs the usual entries
 const (
-	LevelInfo  Level = iota //value is 0
-	LevelError              //value is 1
-	LevelFatal              //value is 2
-	LevelOff                //value is 3
+	LevelDebug Level = iota - 1 //value is -1
+	LevelInfo                   //value is 0
+	LevelWarn                   //value is 1
+	LevelError                  //value is 2
+	LevelFatal                  //value is 3
+	LevelOff                    //value is 4
 )
 
 // The severity levels as a human-readable friendly format
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
@@ -34,56 +45,278 @@ func (l Level) String() string {
 	}
 }
 
-// Define a custom logger
+// ParseLevel() converts a level name such as "debug" or "WARN" into a Level
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// core holds the state shared by a logger and all of its children
+type core struct {
+	out         io.Writer
+	mu          sync.Mutex
+	minLevel    atomic.Int32
+	stackTraces bool
+	sampler     *sampler
+}
+
+// Define a custom logger. A Logger is also a slog.Handler, so
+// slog.New(logger) produces entries in the same format
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	core   *core
+	attrs  []slog.Attr
+	groups []string
+}
+
+// An Option configures optional Logger behaviour
+type Option func(*core)
+
+// WithStackTraces() includes a stack trace in ERROR and FATAL entries
+func WithStackTraces() Option {
+	return func(c *core) {
+		c.stackTraces = true
+	}
+}
+
+// WithSampling() limits high-volume messages. Within each tick the first
+// entries with a given level and message are logged, then only every
+// thereafter-th one. ERROR and FATAL entries are never sampled
+func WithSampling(tick time.Duration, first, thereafter int) Option {
+	return func(c *core) {
+		if first > 0 {
+			c.sampler = newSampler(tick, first, thereafter)
+		}
+	}
 }
 
 // The New() function creates a new instance of Logger
-func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+func New(out io.Writer, minLevel Level, opts ...Option) *Logger {
+	c := &core{out: out}
+	c.minLevel.Store(int32(minLevel))
+	for _, opt := range opts {
+		opt(c)
 	}
+	return &Logger{core: c}
+}
+
+// SetLevel() changes the minimum severity level of the logger and all of its children
+func (l *Logger) SetLevel(level Level) {
+	l.core.minLevel.Store(int32(level))
+}
+
+// Level() returns the current minimum severity level
+func (l *Logger) Level() Level {
+	return Level(l.core.minLevel.Load())
+}
+
+// With() returns a child logger that adds the given fields to every entry
+func (l *Logger) With(fields ...Field) *Logger {
+	return l.withAttrs(fieldAttrs(fields))
 }
 
 // Helper methods
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+	l.print(LevelInfo, message, stringFields(properties))
 }
 
 func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+	l.print(LevelError, err.Error(), stringFields(properties))
 }
 
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
+	l.print(LevelFatal, err.Error(), stringFields(properties))
+	os.Exit(1)
+}
+
+// Debug() writes a DEBUG entry with typed fields
+func (l *Logger) Debug(message string, fields ...Field) {
+	l.print(LevelDebug, message, fields)
+}
+
+// Info() writes an INFO entry with typed fields
+func (l *Logger) Info(message string, fields ...Field) {
+	l.print(LevelInfo, message, fields)
+}
+
+// Warn() writes a WARN entry with typed fields
+func (l *Logger) Warn(message string, fields ...Field) {
+	l.print(LevelWarn, message, fields)
+}
+
+// Error() writes an ERROR entry with typed fields
+func (l *Logger) Error(err error, fields ...Field) {
+	l.print(LevelError, err.Error(), fields)
+}
+
+// Fatal() writes a FATAL entry with typed fields and exits
+func (l *Logger) Fatal(err error, fields ...Field) {
+	l.print(LevelFatal, err.Error(), fields)
 	os.Exit(1)
 }
 
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	// Ensure severity level is at least the minimum
-	if level < l.minLevel {
+// InfoContext() writes an INFO entry that includes the fields carried by ctx
+func (l *Logger) InfoContext(ctx context.Context, message string, fields ...Field) {
+	l.printContext(ctx, LevelInfo, message, fields)
+}
+
+// WarnContext() writes a WARN entry that includes the fields carried by ctx
+func (l *Logger) WarnContext(ctx context.Context, message string, fields ...Field) {
+	l.printContext(ctx, LevelWarn, message, fields)
+}
+
+// ErrorContext() writes an ERROR entry that includes the fields carried by ctx
+func (l *Logger) ErrorContext(ctx context.Context, err error, fields ...Field) {
+	l.printContext(ctx, LevelError, err.Error(), fields)
+}
+
+// contextFieldsKey is the context key for the fields added by ContextWith()
+type contextFieldsKey struct{}
+
+// ContextWith() returns a copy of ctx carrying fields, such as a request ID,
+// that are added to every entry logged with it, whether through the *Context()
+// methods or through slog
+func ContextWith(ctx context.Context, fields ...Field) context.Context {
+	existing := contextAttrs(ctx)
+	attrs := append(existing[:len(existing):len(existing)], fieldAttrs(fields)...)
+	return context.WithValue(ctx, contextFieldsKey{}, attrs)
+}
+
+func contextAttrs(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(contextFieldsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// print() turns a jsonlog call into a slog.Record and hands it to Handle()
+func (l *Logger) print(level Level, message string, fields []Field) (int, error) {
+	return l.printContext(context.Background(), level, message, fields)
+}
+
+func (l *Logger) printContext(ctx context.Context, level Level, message string, fields []Field) (int, error) {
+	if !l.Enabled(ctx, level.slogLevel()) {
+		return 0, nil
+	}
+	record := slog.NewRecord(time.Now(), level.slogLevel(), message, 0)
+	record.AddAttrs(fieldAttrs(fields)...)
+	return l.handle(ctx, record)
+}
+
+// Enabled() implements slog.Handler and reports whether entries at the given level are written
+func (l *Logger) Enabled(_ context.Context, level slog.Level) bool {
+	lvl := levelFromSlog(level)
+	return lvl >= l.Level() && lvl < LevelOff
+}
+
+// Handle() implements slog.Handler and writes a single entry, including the
+// fields carried by ctx
+func (l *Logger) Handle(ctx context.Context, record slog.Record) error {
+	_, err := l.handle(ctx, record)
+	return err
+}
+
+// WithAttrs() implements slog.Handler
+func (l *Logger) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return l.withAttrs(attrs)
+}
+
+// WithGroup() implements slog.Handler. Attributes added afterwards are nested
+// under the group name within the entry's properties
+func (l *Logger) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return l
+	}
+	child := &Logger{core: l.core, attrs: l.attrs}
+	child.groups = append(append(child.groups, l.groups...), name)
+	return child
+}
+
+func (l *Logger) withAttrs(attrs []slog.Attr) *Logger {
+	if len(attrs) == 0 {
+		return l
+	}
+	child := &Logger{core: l.core, groups: l.groups}
+	child.attrs = append(append(child.attrs, l.attrs...), l.inGroups(attrs)...)
+	return child
+}
+
+// inGroups() nests attributes inside the logger's open groups
+func (l *Logger) inGroups(attrs []slog.Attr) []slog.Attr {
+	for i := len(l.groups) - 1; i >= 0; i-- {
+		args := make([]any, len(attrs))
+		for j, a := range attrs {
+			args[j] = a
+		}
+		attrs = []slog.Attr{slog.Group(l.groups[i], args...)}
+	}
+	return attrs
+}
+
+func (l *Logger) handle(ctx context.Context, record slog.Record) (int, error) {
+	level := levelFromSlog(record.Level)
+	// Drop the entry if this message is being logged too often
+	if level < LevelError && l.core.sampler != nil && !l.core.sampler.allow(level, record.Message) {
 		return 0, nil
 	}
+	//collect the logger's preset attributes and the context's, followed by the record's own
+	recordAttrs := make([]slog.Attr, 0, record.NumAttrs())
+	record.Attrs(func(a slog.Attr) bool {
+		recordAttrs = append(recordAttrs, a)
+		return true
+	})
+	ctxAttrs := contextAttrs(ctx)
+	var properties map[string]any
+	if len(l.attrs)+len(ctxAttrs)+len(recordAttrs) > 0 {
+		properties = make(map[string]any)
+		for _, a := range l.attrs {
+			addAttr(properties, a)
+		}
+		for _, a := range ctxAttrs {
+			addAttr(properties, a)
+		}
+		for _, a := range l.inGroups(recordAttrs) {
+			addAttr(properties, a)
+		}
+	}
+	var trace string
+	//should we include the stack trace?
+	if level >= LevelError && l.core.stackTraces {
+		trace = string(debug.Stack())
+	}
+	t := record.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return l.write(level, record.Message, t, properties, trace)
+}
+
+// write() encodes a single entry and writes it to the output
+func (l *Logger) write(level Level, message string, t time.Time, properties map[string]any, trace string) (int, error) {
 	//create a struct for holding the log entry data
 	data := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
-		Time:       time.Now().UTC().Format(time.RFC3339),
+		Time:       t.UTC().Format(time.RFC3339),
 		Message:    message,
 		Properties: properties,
-	}
-	//should we include the stack trace?
-	if level >= LevelError {
-		data.Trace = string(debug.Stack())
+		Trace:      trace,
 	}
 	//Encode the log entry to JSON
 	var entry []byte
@@ -92,12 +325,50 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 		entry = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
 	}
 	//prepare to write the log entry
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	return l.out.Write(append(entry, '\n'))
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	return l.core.out.Write(append(entry, '\n'))
 }
 
 // implement the io.Writer interface
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+// sampler counts entries per level and message within each tick
+type sampler struct {
+	tick       time.Duration
+	first      int
+	thereafter int
+
+	mu     sync.Mutex
+	counts map[string]int
+	reset  time.Time
+}
+
+func newSampler(tick time.Duration, first, thereafter int) *sampler {
+	return &sampler{
+		tick:       tick,
+		first:      first,
+		thereafter: thereafter,
+		counts:     make(map[string]int),
+	}
+}
+
+// allow() reports whether an entry should be written
+func (s *sampler) allow(level Level, message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.reset) {
+		s.counts = make(map[string]int)
+		s.reset = now.Add(s.tick)
+	}
+	key := level.String() + "\x00" + message
+	s.counts[key]++
+	n := s.counts[key]
+	if n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (n-s.first)%s.thereafter == 0
+}
@@ -0,0 +1,122 @@
+package jsonlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an io.WriteCloser that writes to a file and moves it aside
+// once it grows past MaxSize bytes or has been open for longer than Interval.
+// Rotated files are named <name>-<timestamp><ext> and only the newest
+// MaxBackups of them are kept. A zero value for any limit disables it
+type RotatingFile struct {
+	Filename   string
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// Write() implements io.Writer, rotating the file first if needed
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	tooBig := rf.MaxSize > 0 && rf.size+int64(len(p)) > rf.MaxSize && rf.size > 0
+	tooOld := rf.Interval > 0 && time.Since(rf.openedAt) >= rf.Interval
+	if tooBig || tooOld {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close() closes the current file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// open() opens the log file for appending, picking up its existing size
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.Filename), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rf.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+// rotate() renames the current file with a timestamp, opens a new one and prunes old backups
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+
+	ext := filepath.Ext(rf.Filename)
+	prefix := strings.TrimSuffix(rf.Filename, ext)
+	backup := fmt.Sprintf("%s-%s%s", prefix, time.Now().UTC().Format("20060102T150405.000"), ext)
+	if err := os.Rename(rf.Filename, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return rf.prune(prefix, ext)
+}
+
+// prune() removes the oldest backups beyond MaxBackups
+func (rf *RotatingFile) prune(prefix, ext string) error {
+	if rf.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(prefix + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= rf.MaxBackups {
+		return nil
+	}
+	//the timestamp format sorts lexically in time order
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-rf.MaxBackups] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
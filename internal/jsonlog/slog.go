@@ -0,0 +1,97 @@
+package jsonlog
+
+import (
+	"log/slog"
+	"time"
+)
+
+// LevelFatalSlog is the slog level that corresponds to LevelFatal
+const LevelFatalSlog = slog.Level(12)
+
+// slogLevel() maps a jsonlog Level onto the equivalent slog.Level
+func (l Level) slogLevel() slog.Level {
+	switch l {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	default:
+		return LevelFatalSlog
+	}
+}
+
+// levelFromSlog() maps a slog.Level onto the nearest jsonlog Level at or below it
+func levelFromSlog(l slog.Level) Level {
+	switch {
+	case l < slog.LevelInfo:
+		return LevelDebug
+	case l < slog.LevelWarn:
+		return LevelInfo
+	case l < slog.LevelError:
+		return LevelWarn
+	case l < LevelFatalSlog:
+		return LevelError
+	default:
+		return LevelFatal
+	}
+}
+
+// fieldAttrs() converts jsonlog fields into slog attributes
+func fieldAttrs(fields []Field) []slog.Attr {
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	return attrs
+}
+
+// addAttr() adds an attribute to an entry's properties. Groups become nested
+// objects and are merged with any existing group of the same name
+func addAttr(properties map[string]any, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() != slog.KindGroup {
+		properties[a.Key] = attrValue(a.Value)
+		return
+	}
+	group := a.Value.Group()
+	if len(group) == 0 {
+		return
+	}
+	//an unnamed group is inlined into its parent
+	target := properties
+	if a.Key != "" {
+		nested, ok := properties[a.Key].(map[string]any)
+		if !ok {
+			nested = make(map[string]any, len(group))
+			properties[a.Key] = nested
+		}
+		target = nested
+	}
+	for _, ga := range group {
+		addAttr(target, ga)
+	}
+}
+
+// attrValue() converts a slog value into something that encodes well as JSON
+func attrValue(v slog.Value) any {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		return v.Any()
+	default:
+		return v.Any()
+	}
+}
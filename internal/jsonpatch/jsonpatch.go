@@ -0,0 +1,390 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to a JSON document
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Media types of the two patch formats
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalidPatch means the patch document itself is malformed
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrPathNotFound means an operation refers to a location that doesn't exist
+	ErrPathNotFound = errors.New("path not found")
+	// ErrTestFailed means a test operation found a different value
+	ErrTestFailed = errors.New("test failed")
+)
+
+// MergePatch() returns doc with a JSON Merge Patch applied. Members of the
+// patch replace those of doc, objects are merged recursively and null removes a member
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = merge(t[key], value)
+	}
+	return t
+}
+
+// operation is one step of a JSON Patch. Value is kept raw so an explicit
+// null can be told apart from a missing value
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply() returns doc with a JSON Patch applied. The operations are applied in
+// order and if any of them fails the error says which one
+func Apply(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: must be an array of operations", ErrInvalidPatch)
+	}
+	for i, op := range ops {
+		target, err = op.apply(target)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %w", i, op.Op, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+func (op operation) apply(doc any) (any, error) {
+	if op.Path == nil {
+		return nil, fmt.Errorf("%w: path must be provided", ErrInvalidPatch)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var from []string
+	if op.Op == "move" || op.Op == "copy" {
+		if op.From == nil {
+			return nil, fmt.Errorf("%w: from must be provided", ErrInvalidPatch)
+		}
+		if from, err = parsePointer(*op.From); err != nil {
+			return nil, err
+		}
+	}
+	var value any
+	if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: value must be provided", ErrInvalidPatch)
+		}
+		if value, err = decode(op.Value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, value)
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "replace":
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, _, err = remove(doc, path); err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move":
+		if isProperPrefix(from, path) {
+			return nil, fmt.Errorf("%w: a value can't be moved into one of its own children", ErrInvalidPatch)
+		}
+		doc, value, err = remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "copy":
+		if value, err = get(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(value))
+	case "test":
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(current, value) {
+			return nil, fmt.Errorf("%w: %s does not match", ErrTestFailed, *op.Path)
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: op must be add, remove, replace, move, copy or test", ErrInvalidPatch)
+	}
+}
+
+// parsePointer() splits a JSON Pointer (RFC 6901) into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: %q is not a JSON pointer", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isProperPrefix(prefix, path []string) bool {
+	if len(prefix) >= len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex() parses an array index token, which must be in the range [0, max]
+func arrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: %q is not an array index", ErrInvalidPatch, token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("%w: %q is not an array index", ErrInvalidPatch, token)
+	}
+	if index > max {
+		return 0, fmt.Errorf("%w: index %d is out of range", ErrPathNotFound, index)
+	}
+	return index, nil
+}
+
+func get(node any, path []string) (any, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: no member %q", ErrPathNotFound, token)
+			}
+			node = child
+		case []any:
+			index, err := arrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[index]
+		default:
+			return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrPathNotFound, token)
+		}
+	}
+	return node, nil
+}
+
+// add() returns node with value added at path. Arrays are rebuilt, so the
+// caller must store the returned node in place of the old one
+func add(node any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch n := node.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("%w: no member %q", ErrPathNotFound, token)
+		}
+		child, err := add(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = child
+		return n, nil
+	case []any:
+		if len(path) == 1 {
+			index := len(n)
+			if token != "-" {
+				var err error
+				if index, err = arrayIndex(token, len(n)); err != nil {
+					return nil, err
+				}
+			}
+			n = append(n, nil)
+			copy(n[index+1:], n[index:])
+			n[index] = value
+			return n, nil
+		}
+		index, err := arrayIndex(token, len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		if n[index], err = add(n[index], path[1:], value); err != nil {
+			return nil, err
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrPathNotFound, token)
+	}
+}
+
+// remove() returns node without the value at path, along with the removed value
+func remove(node any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: the whole document can't be removed", ErrInvalidPatch)
+	}
+	token := path[0]
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: no member %q", ErrPathNotFound, token)
+		}
+		if len(path) == 1 {
+			delete(n, token)
+			return n, child, nil
+		}
+		child, removed, err := remove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[token] = child
+		return n, removed, nil
+	case []any:
+		index, err := arrayIndex(token, len(n)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := n[index]
+			return append(n[:index:index], n[index+1:]...), removed, nil
+		}
+		child, removed, err := remove(n[index], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[index] = child
+		return n, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %q is not inside an object or array", ErrPathNotFound, token)
+	}
+}
+
+// equal() compares two decoded values the way RFC 6902 tests them, with
+// numbers compared by value rather than by how they were written
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
+
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for key, child := range v {
+			c[key] = deepCopy(child)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, child := range v {
+			c[i] = deepCopy(child)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// decode() parses a single JSON value, keeping numbers exactly as written
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("must contain a single JSON value")
+	}
+	return value, nil
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"database/sql"
+	"runtime"
+)
+
+// NewDBStatsCollector() exposes the connection pool statistics of db
+func NewDBStatsCollector(db *sql.DB) Collector {
+	return CollectorFunc(func(w *Writer) {
+		stats := db.Stats()
+
+		w.Family("db_max_open_connections", "Maximum number of open connections to the database.", "gauge")
+		w.Sample("db_max_open_connections", float64(stats.MaxOpenConnections))
+		w.Family("db_open_connections", "The number of established connections both in use and idle.", "gauge")
+		w.Sample("db_open_connections", float64(stats.OpenConnections))
+		w.Family("db_in_use_connections", "The number of connections currently in use.", "gauge")
+		w.Sample("db_in_use_connections", float64(stats.InUse))
+		w.Family("db_idle_connections", "The number of idle connections.", "gauge")
+		w.Sample("db_idle_connections", float64(stats.Idle))
+		w.Family("db_wait_count_total", "The total number of connections waited for.", "counter")
+		w.Sample("db_wait_count_total", float64(stats.WaitCount))
+		w.Family("db_wait_duration_seconds_total", "The total time blocked waiting for a new connection.", "counter")
+		w.Sample("db_wait_duration_seconds_total", stats.WaitDuration.Seconds())
+		w.Family("db_max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns.", "counter")
+		w.Sample("db_max_idle_closed_total", float64(stats.MaxIdleClosed))
+		w.Family("db_max_idle_time_closed_total", "The total number of connections closed due to SetConnMaxIdleTime.", "counter")
+		w.Sample("db_max_idle_time_closed_total", float64(stats.MaxIdleTimeClosed))
+		w.Family("db_max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime.", "counter")
+		w.Sample("db_max_lifetime_closed_total", float64(stats.MaxLifetimeClosed))
+	})
+}
+
+// NewRuntimeCollector() exposes goroutine, memory and garbage collector statistics
+func NewRuntimeCollector() Collector {
+	return CollectorFunc(func(w *Writer) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		w.Family("go_goroutines", "Number of goroutines that currently exist.", "gauge")
+		w.Sample("go_goroutines", float64(runtime.NumGoroutine()))
+		w.Family("go_info", "Information about the Go environment.", "gauge")
+		w.Sample("go_info", 1, "version", runtime.Version())
+		w.Family("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge")
+		w.Sample("go_memstats_alloc_bytes", float64(m.Alloc))
+		w.Family("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", "counter")
+		w.Sample("go_memstats_alloc_bytes_total", float64(m.TotalAlloc))
+		w.Family("go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge")
+		w.Sample("go_memstats_sys_bytes", float64(m.Sys))
+		w.Family("go_memstats_heap_objects", "Number of allocated objects.", "gauge")
+		w.Sample("go_memstats_heap_objects", float64(m.HeapObjects))
+		w.Family("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", "gauge")
+		w.Sample("go_memstats_heap_inuse_bytes", float64(m.HeapInuse))
+		w.Family("go_gc_cycles_total", "Number of completed GC cycles.", "counter")
+		w.Sample("go_gc_cycles_total", float64(m.NumGC))
+		w.Family("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter")
+		w.Sample("go_gc_pause_seconds_total", float64(m.PauseTotalNs)/1e9)
+	})
+}
@@ -0,0 +1,267 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default latency buckets (in seconds) for histograms
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Collector writes one or more metric families whenever the registry is scraped
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// Registry holds every collector that is exposed at the metrics endpoint
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// The NewRegistry() function creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register() adds a collector to the registry
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounterVec() creates and registers a counter partitioned by the given labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	r.Register(c)
+	return c
+}
+
+// NewHistogramVec() creates and registers a histogram partitioned by the given labels
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogramValue)}
+	r.Register(h)
+	return h
+}
+
+// WriteTo() writes every registered collector in the Prometheus text format
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	w := &Writer{bw: bufio.NewWriter(out)}
+	for _, c := range collectors {
+		c.Collect(w)
+	}
+	if err := w.bw.Flush(); err != nil {
+		return w.n, err
+	}
+	return w.n, nil
+}
+
+// Handler() returns an http.Handler that serves the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Writer formats metric families in the Prometheus text exposition format
+type Writer struct {
+	bw *bufio.Writer
+	n  int64
+}
+
+// Family() writes the HELP and TYPE lines that precede a metric's samples
+func (w *Writer) Family(name, help, typ string) {
+	w.printf("# HELP %s %s\n", name, escapeHelp(help))
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Sample() writes a single sample line. Labels are given as name/value pairs
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(value))
+}
+
+func (w *Writer) printf(format string, args ...any) {
+	n, _ := fmt.Fprintf(w.bw, format, args...)
+	w.n += int64(n)
+}
+
+// CounterVec is a monotonically increasing value partitioned by labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Add() increments the counter identified by the label values
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: labelValues}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+// Inc() increments the counter identified by the label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Collect() implements the Collector interface
+func (c *CounterVec) Collect(w *Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Family(c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		w.Sample(c.name, v.value, pairs(c.labels, v.labelValues)...)
+	}
+}
+
+// HistogramVec counts observations in configurable buckets, partitioned by labels
+type HistogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// Observe() records a value in the histogram identified by the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// Collect() implements the Collector interface
+func (h *HistogramVec) Collect(w *Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Family(h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		labels := pairs(h.labels, v.labelValues)
+		for i, upper := range h.buckets {
+			w.Sample(h.name+"_bucket", float64(v.counts[i]), append(labels, "le", formatFloat(upper))...)
+		}
+		w.Sample(h.name+"_bucket", float64(v.count), append(labels, "le", "+Inf")...)
+		w.Sample(h.name+"_sum", v.sum, labels...)
+		w.Sample(h.name+"_count", float64(v.count), labels...)
+	}
+}
+
+// CollectorFunc adapts an ordinary function to the Collector interface
+type CollectorFunc func(w *Writer)
+
+// Collect() calls f(w)
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// pairs() zips label names and values into a name/value slice
+func pairs(names, values []string) []string {
+	out := make([]string, 0, 2*len(names)+2)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		out = append(out, name, value)
+	}
+	return out
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+	ErrInvalidKey   = errors.New("invalid blob key")
+)
+
+// BlobStore stores opaque binary objects under slash separated keys such as
+// "schools/1/3f9a". Implementations must be safe for concurrent use
+type BlobStore interface {
+	// Put() stores the contents of r under key, replacing any existing blob,
+	// and returns the number of bytes written
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Open() returns a reader for the blob. Seeking lets callers serve Range requests
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete() removes the blob. Deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStore is a BlobStore that keeps each blob as a file below a root directory
+type LocalStore struct {
+	root string
+}
+
+// The NewLocalStore() function creates a LocalStore rooted at dir, creating the directory if needed
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: dir}, nil
+}
+
+// path() maps a key onto a file below the root, refusing keys that would escape it
+func (s *LocalStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put() writes the blob to a temporary file and renames it into place so
+// readers never see a partially written blob
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return 0, err
+	}
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	tmp := path + ".tmp-" + hex.EncodeToString(suffix)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, contextReader{ctx, r})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, nil
+}
+
+// Open() opens the blob's file for reading
+func (s *LocalStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return nil, ErrBlobNotFound
+		default:
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Delete() removes the blob's file
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// contextReader stops a copy once its context has been cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,162 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	//register the remaining decoders with image.Decode()
+	_ "image/gif"
+)
+
+// MaxPixels is the largest image, in pixels, that will be decoded. It stops a
+// small, highly compressed upload from exhausting memory
+const MaxPixels = 40_000_000
+
+var (
+	// ErrUnsupportedFormat is returned for images the standard library can't decode, such as WebP
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrImageTooLarge     = errors.New("image is too large to decode")
+	// ErrCorruptImage is returned for images in a supported format that fail to decode, such as truncated uploads
+	ErrCorruptImage = errors.New("corrupt image")
+)
+
+// Supported() reports whether images of the content type can be thumbnailed
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Make() decodes the image read from src and writes a size x size thumbnail
+// to dst. The image is cropped around its centre to a square and then scaled
+// down. PNG sources produce a PNG, to keep any transparency, and everything
+// else produces a JPEG on a white background. It returns the thumbnail's content type
+func Make(dst io.Writer, src io.ReadSeeker, size int) (string, error) {
+	r := &recordingReader{ReadSeeker: src}
+	//check the dimensions before decoding the whole image
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", r.decodeError(err)
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return "", ErrImageTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return "", r.decodeError(err)
+	}
+	thumb := resize(crop(img), size)
+
+	if format == "png" {
+		return "image/png", png.Encode(dst, thumb)
+	}
+	return "image/jpeg", jpeg.Encode(dst, flatten(thumb), &jpeg.Options{Quality: 85})
+}
+
+// recordingReader keeps the last error reading src returned, so that a failure
+// to read can be told apart from an image that doesn't decode
+type recordingReader struct {
+	io.ReadSeeker
+	err error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// decodeError() maps an error from the image decoders. Read errors are passed
+// on as they may be temporary, anything else is down to the image itself
+func (r *recordingReader) decodeError(err error) error {
+	switch {
+	case r.err != nil:
+		return r.err
+	case errors.Is(err, image.ErrFormat):
+		return ErrUnsupportedFormat
+	default:
+		return fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+}
+
+// flatten() composites img onto white, as JPEG has no transparency and would
+// otherwise turn transparent pixels black
+func flatten(img *image.NRGBA) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// crop() returns the largest square around the centre of img as an NRGBA image
+func crop(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	square := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, image.Pt(x0, y0), draw.Src)
+	return square
+}
+
+// resize() scales a square image to size x size. Each destination pixel is the
+// average of the source pixels it covers, which gives smooth results when
+// shrinking. Smaller sources fall back to nearest neighbour
+func resize(src *image.NRGBA, size int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	side := src.Bounds().Dx()
+	if side == 0 {
+		return dst
+	}
+	for dy := 0; dy < size; dy++ {
+		sy0 := dy * side / size
+		sy1 := (dy + 1) * side / size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0 := dx * side / size
+			sx1 := (dx + 1) * side / size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					//weight the colour by alpha so transparent pixels don't darken the edges
+					alpha := uint64(src.Pix[i+3])
+					r += uint64(src.Pix[i]) * alpha
+					g += uint64(src.Pix[i+1]) * alpha
+					b += uint64(src.Pix[i+2]) * alpha
+					a += alpha
+					n++
+					i += 4
+				}
+			}
+			o := dst.PixOffset(dx, dy)
+			if a > 0 {
+				dst.Pix[o] = uint8(r / a)
+				dst.Pix[o+1] = uint8(g / a)
+				dst.Pix[o+2] = uint8(b / a)
+			}
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
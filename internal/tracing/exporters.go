@@ -0,0 +1,238 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Exporter receives finished spans
+type Exporter interface {
+	Export(span *Span)
+	Shutdown(ctx context.Context) error
+}
+
+// batchExporter buffers spans and sends them in batches from a background goroutine
+type batchExporter struct {
+	spans   chan *Span
+	send    func([]*Span) error
+	onError func(error)
+	done    chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+}
+
+const (
+	maxBatchSize  = 256
+	flushInterval = 5 * time.Second
+)
+
+func newBatchExporter(send func([]*Span) error, onError func(error)) *batchExporter {
+	e := &batchExporter{
+		spans:   make(chan *Span, 4*maxBatchSize),
+		send:    send,
+		onError: onError,
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export() queues a span, dropping it if the buffer is full rather than blocking the request
+func (e *batchExporter) Export(span *Span) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- span:
+	default:
+		e.reportError(fmt.Errorf("span buffer full, dropping span %q", span.Name))
+	}
+}
+
+// Shutdown() sends any buffered spans and stops the background goroutine
+func (e *batchExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mu.Unlock()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *batchExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			e.reportError(err)
+		}
+		batch = make([]*Span, 0, maxBatchSize)
+	}
+	for {
+		select {
+		case span, ok := <-e.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (e *batchExporter) reportError(err error) {
+	if e.onError != nil {
+		e.onError(err)
+	}
+}
+
+// NewWriterExporter() writes each span as a line of JSON, which is handy for
+// stdout or a local file when there is no collector
+func NewWriterExporter(w io.Writer, service string, onError func(error)) Exporter {
+	return newBatchExporter(func(spans []*Span) error {
+		enc := json.NewEncoder(w)
+		for _, span := range spans {
+			entry := struct {
+				Service    string         `json:"service"`
+				Name       string         `json:"name"`
+				TraceID    string         `json:"trace_id"`
+				SpanID     string         `json:"span_id"`
+				ParentID   string         `json:"parent_id,omitempty"`
+				Start      time.Time      `json:"start"`
+				Duration   string         `json:"duration"`
+				Attributes map[string]any `json:"attributes,omitempty"`
+				Error      string         `json:"error,omitempty"`
+			}{
+				Service:    service,
+				Name:       span.Name,
+				TraceID:    span.TraceID.String(),
+				SpanID:     span.SpanID.String(),
+				Start:      span.Start.UTC(),
+				Duration:   span.End.Sub(span.Start).String(),
+				Attributes: span.Attributes,
+				Error:      span.Err,
+			}
+			if span.ParentID.IsValid() {
+				entry.ParentID = span.ParentID.String()
+			}
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, onError)
+}
+
+// NewOTLPExporter() sends spans to an OpenTelemetry collector using OTLP over
+// HTTP with the JSON encoding. endpoint is the collector's base URL, for
+// example http://localhost:4318
+func NewOTLPExporter(endpoint, service string, onError func(error)) Exporter {
+	url := strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return newBatchExporter(func(spans []*Span) error {
+		body, err := json.Marshal(otlpRequest(service, spans))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("otlp exporter: collector responded with %s", resp.Status)
+		}
+		return nil
+	}, onError)
+}
+
+// otlpRequest() builds an ExportTraceServiceRequest in its JSON form
+func otlpRequest(service string, spans []*Span) map[string]any {
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, span := range spans {
+		s := map[string]any{
+			"traceId":           span.TraceID.String(),
+			"spanId":            span.SpanID.String(),
+			"name":              span.Name,
+			"kind":              int(span.Kind),
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+		}
+		if span.ParentID.IsValid() {
+			s["parentSpanId"] = span.ParentID.String()
+		}
+		if span.Err != "" {
+			//STATUS_CODE_ERROR
+			s["status"] = map[string]any{"code": 2, "message": span.Err}
+		}
+		otlpSpans = append(otlpSpans, s)
+	}
+	return map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": otlpAttributes(map[string]any{"service.name": service}),
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "github.com/kirwadee/appletree/internal/tracing"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		out = append(out, map[string]any{"key": key, "value": v})
+	}
+	return out
+}
@@ -0,0 +1,231 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a whole trace and SpanID a single span within it
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether the ID is not all zeroes
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanKind describes the relationship of a span to the rest of the trace
+type SpanKind int
+
+// The values match the OTLP SpanKind enumeration
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Span records a timed operation. All methods are safe to call on a nil Span,
+// which is what StartSpan() returns when there is no tracer in the context
+type Span struct {
+	tracer     *Tracer
+	Name       string
+	Kind       SpanKind
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Sampled    bool
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Err        string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetName() renames the span, for example once the route is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Name = name
+}
+
+// SetAttribute() records a key/value pair on the span
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// RecordError() marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err.Error()
+}
+
+// Finish() ends the span and hands it to the tracer's exporter
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+// Traceparent() formats the span context as a W3C traceparent header value
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// Tracer creates spans and passes finished ones to an Exporter
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// The New() function creates a Tracer that reports spans for the named service
+func New(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// Service() returns the service name spans are reported under
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+// Shutdown() flushes any buffered spans
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+func (t *Tracer) export(s *Span) {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	t.exporter.Export(s)
+}
+
+// Start() begins a new span. Its parent is the span already in ctx or, failing
+// that, the remote parent extracted by ContextWithRemoteParent()
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Sampled:    true,
+		Start:      time.Now(),
+		Attributes: make(map[string]any),
+	}
+	switch parent := ctx.Value(spanContextKey).(type) {
+	case *Span:
+		span.TraceID, span.ParentID, span.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	case remoteParent:
+		span.TraceID, span.ParentID, span.Sampled = parent.traceID, parent.spanID, parent.sampled
+	default:
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanContextKey, span), span
+}
+
+type contextKey string
+
+const spanContextKey = contextKey("span")
+
+// remoteParent holds the span context received from an upstream caller
+type remoteParent struct {
+	traceID TraceID
+	spanID  SpanID
+	sampled bool
+}
+
+// SpanFromContext() returns the current span, or nil if there isn't one
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// StartSpan() begins a child of the span in ctx using that span's tracer.
+// It returns a nil span when ctx isn't being traced
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, KindInternal)
+}
+
+// ContextWithRemoteParent() parses a W3C traceparent header and, if it is valid,
+// returns a context whose next span continues the caller's trace
+func ContextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ctx
+	}
+	//version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return ctx
+	}
+	var parent remoteParent
+	if !decodeHex(parent.traceID[:], parts[1]) || !decodeHex(parent.spanID[:], parts[2]) {
+		return ctx
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return ctx
+	}
+	if !parent.traceID.IsValid() || !parent.spanID.IsValid() {
+		return ctx
+	}
+	parent.sampled = flags[0]&0x01 == 0x01
+	return context.WithValue(ctx, spanContextKey, parent)
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
@@ -1,8 +1,13 @@
 package validator
 
 import (
+	"net/netip"
 	"net/url"
 	"regexp"
+	"strings"
+	"time"
+	//the time zone database, so time zones validate the same on every host
+	_ "time/tzdata"
 )
 
 var (
@@ -49,6 +54,58 @@ func ValidWebsite(website string) bool {
 	return err == nil
 }
 
+// Between() checks that an integer value lies within min and max, inclusive
+func Between(value, min, max int) bool {
+	return value >= min && value <= max
+}
+
+// ValidDate() checks that a string value is a calendar date in YYYY-MM-DD format
+func ValidDate(value string) bool {
+	_, err := time.Parse(time.DateOnly, value)
+	return err == nil
+}
+
+// NotBefore() checks that the date end doesn't fall before the date start.
+// Both must be valid YYYY-MM-DD dates, which sort the same way as strings
+func NotBefore(start, end string) bool {
+	return ValidDate(start) && ValidDate(end) && end >= start
+}
+
+// ValidTimeZone() checks that a string value names a time zone in the IANA database
+func ValidTimeZone(name string) bool {
+	//LoadLocation() treats "" and "Local" as the server's own zone
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range from RFC 6598, which like
+// the private ranges isn't reachable from the internet
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// PublicAddr() checks that an IP address is a unicast address on the public
+// internet, rather than a loopback, link-local, private or unspecified one
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// PublicHost() checks that the host of a URL doesn't name this machine or an
+// address off the public internet. Names are only checked against localhost,
+// as what they resolve to can change after they are validated
+func PublicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return PublicAddr(addr)
+	}
+	return true
+}
+
 // AddError() adds an error entry to the Errors map
 func (v *Validator) AddError(key, message string) {
 	//check if the key doesnt exists in a map
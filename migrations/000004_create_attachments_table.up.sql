@@ -0,0 +1,14 @@
+--Filename: migrations/000004_create_attachments_table.up.sql
+
+CREATE TABLE IF NOT EXISTS attachments(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    school_id bigint NOT NULL REFERENCES schools ON DELETE CASCADE,
+    kind text NOT NULL,
+    filename text NOT NULL,
+    content_type text NOT NULL,
+    size bigint NOT NULL,
+    storage_key text NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS attachments_school_id_idx ON attachments(school_id);
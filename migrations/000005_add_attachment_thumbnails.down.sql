@@ -0,0 +1,5 @@
+--Filename: migrations/000005_add_attachment_thumbnails.down.sql
+
+DROP INDEX IF EXISTS attachments_school_logo_idx;
+ALTER TABLE attachments DROP COLUMN IF EXISTS thumbnail_content_type;
+ALTER TABLE attachments DROP COLUMN IF EXISTS thumbnail_key;
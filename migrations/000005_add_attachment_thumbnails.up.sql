@@ -0,0 +1,7 @@
+--Filename: migrations/000005_add_attachment_thumbnails.up.sql
+
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_key text NOT NULL DEFAULT '';
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_content_type text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS attachments_school_logo_idx ON attachments(school_id, id DESC)
+WHERE kind = 'logo' AND thumbnail_key <> '';
@@ -0,0 +1,3 @@
+--Filename: migrations/000006_create_jobs_table.down.sql
+
+DROP TABLE IF EXISTS jobs;
@@ -0,0 +1,22 @@
+--Filename: migrations/000006_create_jobs_table.up.sql
+
+CREATE TABLE IF NOT EXISTS jobs(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    kind text NOT NULL,
+    payload jsonb NOT NULL DEFAULT '{}',
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL DEFAULT 5,
+    run_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    locked_at timestamp with time zone,
+    finished_at timestamp with time zone,
+    last_error text NOT NULL DEFAULT ''
+);
+
+ALTER TABLE jobs ADD CONSTRAINT jobs_status_check CHECK (status IN ('pending', 'running', 'done', 'dead'));
+
+--the dispatcher claims due pending jobs and running jobs whose lease has expired
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs(run_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS jobs_running_idx ON jobs(locked_at) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS jobs_kind_status_idx ON jobs(kind, status);
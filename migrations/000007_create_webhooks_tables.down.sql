@@ -0,0 +1,4 @@
+--Filename: migrations/000007_create_webhooks_tables.down.sql
+
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
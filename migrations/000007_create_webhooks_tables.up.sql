@@ -0,0 +1,36 @@
+--Filename: migrations/000007_create_webhooks_tables.up.sql
+
+CREATE TABLE IF NOT EXISTS webhooks(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    url text NOT NULL,
+    events text[] NOT NULL,
+    secret text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    active boolean NOT NULL DEFAULT true,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    webhook_id bigint NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id text NOT NULL,
+    event text NOT NULL,
+    payload jsonb NOT NULL,
+    replay_of bigint REFERENCES webhook_deliveries ON DELETE SET NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    response_status integer NOT NULL DEFAULT 0,
+    response_body text NOT NULL DEFAULT '',
+    error text NOT NULL DEFAULT '',
+    duration_ms integer NOT NULL DEFAULT 0,
+    last_attempt_at timestamp with time zone
+);
+
+ALTER TABLE webhook_deliveries ADD CONSTRAINT webhook_deliveries_status_check CHECK (status IN ('pending', 'succeeded', 'failed'));
+
+--an event is delivered to a subscription once, apart from replays
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries(webhook_id, event_id) WHERE replay_of IS NULL;
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries(webhook_id, id DESC);
+CREATE INDEX IF NOT EXISTS webhooks_events_idx ON webhooks USING GIN(events);
@@ -0,0 +1,5 @@
+--Filename: migrations/000008_create_school_changes_table.down.sql
+
+DROP TRIGGER IF EXISTS schools_record_change ON schools;
+DROP FUNCTION IF EXISTS record_school_change();
+DROP TABLE IF EXISTS school_changes;
@@ -0,0 +1,42 @@
+--Filename: migrations/000008_create_school_changes_table.up.sql
+
+CREATE TABLE IF NOT EXISTS school_changes(
+    seq bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    school_id bigint NOT NULL,
+    operation text NOT NULL,
+    version integer NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS school_changes_school_id_idx ON school_changes(school_id, seq);
+
+--record every change to a school and wake up the listeners. The advisory lock
+--is held until the writing transaction ends, so sequence numbers become visible
+--in the order they were handed out and a reader that has seen seq N will never
+--later find a smaller one
+CREATE OR REPLACE FUNCTION record_school_change() RETURNS trigger AS $$
+DECLARE
+    change_seq bigint;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('school_changes'));
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (OLD.id, 'deleted', OLD.version)
+        RETURNING seq INTO change_seq;
+    ELSIF TG_OP = 'INSERT' THEN
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (NEW.id, 'created', NEW.version)
+        RETURNING seq INTO change_seq;
+    ELSE
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (NEW.id, 'updated', NEW.version)
+        RETURNING seq INTO change_seq;
+    END IF;
+    PERFORM pg_notify('school_changes', change_seq::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER schools_record_change
+AFTER INSERT OR UPDATE OR DELETE ON schools
+FOR EACH ROW EXECUTE FUNCTION record_school_change();
@@ -0,0 +1,31 @@
+--Filename: migrations/000009_add_schools_change_seq.down.sql
+
+DROP TRIGGER IF EXISTS schools_stamp_change ON schools;
+DROP FUNCTION IF EXISTS stamp_school_change();
+
+CREATE OR REPLACE FUNCTION record_school_change() RETURNS trigger AS $$
+DECLARE
+    change_seq bigint;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('school_changes'));
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (OLD.id, 'deleted', OLD.version)
+        RETURNING seq INTO change_seq;
+    ELSIF TG_OP = 'INSERT' THEN
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (NEW.id, 'created', NEW.version)
+        RETURNING seq INTO change_seq;
+    ELSE
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (NEW.id, 'updated', NEW.version)
+        RETURNING seq INTO change_seq;
+    END IF;
+    PERFORM pg_notify('school_changes', change_seq::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP INDEX IF EXISTS school_changes_deleted_idx;
+DROP INDEX IF EXISTS schools_change_seq_idx;
+ALTER TABLE schools DROP COLUMN IF EXISTS change_seq;
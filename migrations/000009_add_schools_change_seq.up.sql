@@ -0,0 +1,47 @@
+--Filename: migrations/000009_add_schools_change_seq.up.sql
+
+--every school carries the sequence number of its latest change, from the same
+--sequence as school_changes, so the changes since a sync token can be read
+--straight from the schools table along with the tombstones of deleted schools
+ALTER TABLE schools ADD COLUMN IF NOT EXISTS change_seq bigint;
+
+ALTER TABLE schools DISABLE TRIGGER schools_record_change;
+UPDATE schools SET change_seq = nextval(pg_get_serial_sequence('school_changes', 'seq'));
+ALTER TABLE schools ENABLE TRIGGER schools_record_change;
+
+ALTER TABLE schools ALTER COLUMN change_seq SET NOT NULL;
+CREATE INDEX IF NOT EXISTS schools_change_seq_idx ON schools(change_seq);
+CREATE INDEX IF NOT EXISTS school_changes_deleted_idx ON school_changes(seq) WHERE operation = 'deleted';
+
+--take the lock before drawing the number, see record_school_change()
+CREATE OR REPLACE FUNCTION stamp_school_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('school_changes'));
+    NEW.change_seq := nextval(pg_get_serial_sequence('school_changes', 'seq'));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER schools_stamp_change
+BEFORE INSERT OR UPDATE ON schools
+FOR EACH ROW EXECUTE FUNCTION stamp_school_change();
+
+--record the change under the number stamped on the row, deletions draw their own
+CREATE OR REPLACE FUNCTION record_school_change() RETURNS trigger AS $$
+DECLARE
+    next_seq bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_advisory_xact_lock(hashtext('school_changes'));
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (OLD.id, 'deleted', OLD.version)
+        RETURNING seq INTO next_seq;
+    ELSE
+        next_seq := NEW.change_seq;
+        INSERT INTO school_changes(seq, school_id, operation, version)
+        VALUES (next_seq, NEW.id, CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END, NEW.version);
+    END IF;
+    PERFORM pg_notify('school_changes', next_seq::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,4 @@
+--Filename: migrations/000010_add_schools_external_id.down.sql
+
+DROP INDEX IF EXISTS schools_external_id_key;
+ALTER TABLE schools DROP COLUMN IF EXISTS external_id;
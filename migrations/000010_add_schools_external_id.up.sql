@@ -0,0 +1,6 @@
+--Filename: migrations/000010_add_schools_external_id.up.sql
+
+--the school's code in an outside registry, NULL for schools that have none
+ALTER TABLE schools ADD COLUMN IF NOT EXISTS external_id text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS schools_external_id_key ON schools(external_id);
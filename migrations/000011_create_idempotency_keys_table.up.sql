@@ -0,0 +1,14 @@
+--Filename: migrations/000011_create_idempotency_keys_table.up.sql
+
+--a key is in progress while status_code is NULL, locked_at lets an abandoned one be taken over
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+    key text PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    fingerprint text NOT NULL,
+    locked_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    status_code integer,
+    response_header jsonb,
+    response_body bytea
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys(created_at);
@@ -0,0 +1,6 @@
+--Filename: migrations/000012_create_school_merges_tables.down.sql
+
+DROP TABLE IF EXISTS school_merges;
+DROP TABLE IF EXISTS school_revisions;
+DROP INDEX IF EXISTS schools_name_trgm_idx;
+DROP EXTENSION IF EXISTS pg_trgm;
@@ -0,0 +1,27 @@
+--Filename: migrations/000012_create_school_merges_tables.up.sql
+
+--trigram similarity of names finds likely duplicates
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS schools_name_trgm_idx ON schools USING gin (name gin_trgm_ops);
+
+--snapshots of schools taken before a merge changed or removed them. There is
+--no foreign key as the snapshot of a merged school outlives it
+CREATE TABLE IF NOT EXISTS school_revisions(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    school_id bigint NOT NULL,
+    version integer NOT NULL,
+    reason text NOT NULL,
+    snapshot jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS school_revisions_school_id_idx ON school_revisions(school_id, id);
+
+--schools that were merged into another, so their old id can be redirected
+CREATE TABLE IF NOT EXISTS school_merges(
+    merged_id bigint PRIMARY KEY,
+    into_id bigint NOT NULL REFERENCES schools ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS school_merges_into_id_idx ON school_merges(into_id);
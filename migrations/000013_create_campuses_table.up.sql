@@ -0,0 +1,14 @@
+--Filename: migrations/000013_create_campuses_table.up.sql
+
+CREATE TABLE IF NOT EXISTS campuses(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    school_id bigint NOT NULL REFERENCES schools ON DELETE CASCADE,
+    name text NOT NULL,
+    address text NOT NULL,
+    phone text NOT NULL,
+    mode text[] NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS campuses_school_id_idx ON campuses(school_id);
@@ -0,0 +1,3 @@
+--Filename: migrations/000014_create_programs_table.down.sql
+
+DROP TABLE IF EXISTS programs;
@@ -0,0 +1,21 @@
+--Filename: migrations/000014_create_programs_table.up.sql
+
+CREATE TABLE IF NOT EXISTS programs(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    school_id bigint NOT NULL REFERENCES schools ON DELETE CASCADE,
+    name text NOT NULL,
+    min_age integer NOT NULL,
+    max_age integer NOT NULL,
+    capacity integer NOT NULL,
+    enrolled integer NOT NULL DEFAULT 0,
+    fees bigint NOT NULL,
+    term_start date NOT NULL,
+    term_end date NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT programs_age_range_check CHECK (min_age >= 0 AND min_age <= max_age),
+    CONSTRAINT programs_enrolled_check CHECK (enrolled >= 0 AND enrolled <= capacity),
+    CONSTRAINT programs_term_check CHECK (term_start <= term_end)
+);
+
+CREATE INDEX IF NOT EXISTS programs_school_id_idx ON programs(school_id);
@@ -0,0 +1,6 @@
+--Filename: migrations/000015_create_school_calendar_tables.down.sql
+
+DROP TABLE IF EXISTS school_closures;
+DROP EXTENSION IF EXISTS btree_gist;
+DROP TABLE IF EXISTS opening_hours;
+ALTER TABLE schools DROP COLUMN IF EXISTS time_zone;
@@ -0,0 +1,37 @@
+--Filename: migrations/000015_create_school_calendar_tables.up.sql
+
+--opening hours and closures are read in the school's own time zone
+ALTER TABLE schools ADD COLUMN IF NOT EXISTS time_zone text NOT NULL DEFAULT 'UTC';
+
+--the weekly opening hours, weekday 0 is Sunday as in extract(dow). An interval
+--that runs past midnight is stored as two, closing at 24:00 and opening at 00:00
+CREATE TABLE IF NOT EXISTS opening_hours(
+    id bigserial PRIMARY KEY,
+    school_id bigint NOT NULL REFERENCES schools ON DELETE CASCADE,
+    weekday smallint NOT NULL,
+    opens_at time NOT NULL,
+    closes_at time NOT NULL,
+    CONSTRAINT opening_hours_weekday_check CHECK (weekday BETWEEN 0 AND 6),
+    CONSTRAINT opening_hours_interval_check CHECK (opens_at < closes_at)
+);
+
+CREATE INDEX IF NOT EXISTS opening_hours_school_id_idx ON opening_hours(school_id, weekday);
+
+--days a school is closed, such as holidays, from starts_on to ends_on inclusive.
+--btree_gist lets the exclusion constraint compare school ids, so one school's
+--closures can't overlap
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+CREATE TABLE IF NOT EXISTS school_closures(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    school_id bigint NOT NULL REFERENCES schools ON DELETE CASCADE,
+    starts_on date NOT NULL,
+    ends_on date NOT NULL,
+    reason text NOT NULL,
+    CONSTRAINT school_closures_dates_check CHECK (starts_on <= ends_on),
+    CONSTRAINT school_closures_no_overlap EXCLUDE USING gist (
+        school_id WITH =,
+        daterange(starts_on, ends_on, '[]') WITH &&
+    )
+);
@@ -0,0 +1,22 @@
+--Filename: migrations/000016_add_school_changes_snapshot.down.sql
+
+CREATE OR REPLACE FUNCTION record_school_change() RETURNS trigger AS $$
+DECLARE
+    next_seq bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_advisory_xact_lock(hashtext('school_changes'));
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (OLD.id, 'deleted', OLD.version)
+        RETURNING seq INTO next_seq;
+    ELSE
+        next_seq := NEW.change_seq;
+        INSERT INTO school_changes(seq, school_id, operation, version)
+        VALUES (next_seq, NEW.id, CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END, NEW.version);
+    END IF;
+    PERFORM pg_notify('school_changes', next_seq::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE school_changes DROP COLUMN IF EXISTS school;
@@ -0,0 +1,29 @@
+--Filename: migrations/000016_add_school_changes_snapshot.up.sql
+
+--every change keeps the school as it was written, so a change read later
+--carries the state it made rather than whatever the school looks like now
+ALTER TABLE school_changes ADD COLUMN IF NOT EXISTS school jsonb;
+
+--the state of older changes is lost, except for the latest change of each school
+UPDATE school_changes c SET school = to_jsonb(s)
+FROM schools s
+WHERE s.change_seq = c.seq;
+
+CREATE OR REPLACE FUNCTION record_school_change() RETURNS trigger AS $$
+DECLARE
+    next_seq bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_advisory_xact_lock(hashtext('school_changes'));
+        INSERT INTO school_changes(school_id, operation, version)
+        VALUES (OLD.id, 'deleted', OLD.version)
+        RETURNING seq INTO next_seq;
+    ELSE
+        next_seq := NEW.change_seq;
+        INSERT INTO school_changes(seq, school_id, operation, version, school)
+        VALUES (next_seq, NEW.id, CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END, NEW.version, to_jsonb(NEW));
+    END IF;
+    PERFORM pg_notify('school_changes', next_seq::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;